@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// RefreshOn401 middleware calls refresh on 401 Unauthorized response and repeats the request once, i.e. to renew
+// an expired token. The refresh should update the auth source used by an inner middleware setting credentials,
+// the headers of the request itself are not changed. The body replayed with GetBody, requests with a body and
+// without GetBody are not repeated. The 401 response returned if refresh failed or can't be repeated.
+func RefreshOn401(refresh func(ctx context.Context) error) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				return resp, err
+			}
+			if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+				return resp, nil // body can't be replayed
+			}
+			if refresh(req.Context()) != nil {
+				return resp, nil
+			}
+
+			r := req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, e := req.GetBody()
+				if e != nil {
+					_ = resp.Body.Close()
+					return nil, fmt.Errorf("refresh on 401 get body: %w", e)
+				}
+				r.Body = body
+			}
+			_ = resp.Body.Close() // unauthorized response discarded
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
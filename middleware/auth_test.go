@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestRefreshOn401(t *testing.T) {
+	token := "expired"
+	var bodies []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			return &http.Response{StatusCode: http.StatusUnauthorized, Body: io.NopCloser(bytes.NewBufferString("denied"))}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("ok"))}, nil
+	}}
+	auth := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Set("Authorization", "Bearer "+token)
+			return next.RoundTrip(req)
+		})
+	}
+
+	t.Run("refreshed", func(t *testing.T) {
+		token, bodies = "expired", nil
+		rmock.ResetCalls()
+		refreshes := 0
+		h := RefreshOn401(func(ctx context.Context) error {
+			refreshes++
+			token = "valid"
+			return nil
+		})(auth(rmock))
+
+		req, err := http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("payload"))
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 1, refreshes)
+		assert.Equal(t, []string{"payload", "payload"}, bodies, "body replayed")
+
+		resp, err = h.RoundTrip(req.Clone(context.Background()))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 1, refreshes, "no refresh for authorized request")
+		assert.Equal(t, 3, rmock.Calls())
+	})
+
+	t.Run("refresh failed", func(t *testing.T) {
+		token, bodies = "expired", nil
+		rmock.ResetCalls()
+		h := RefreshOn401(func(ctx context.Context) error { return errors.New("refresh failed") })(auth(rmock))
+
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "denied", string(body))
+		assert.Equal(t, 1, rmock.Calls())
+	})
+
+	t.Run("still unauthorized", func(t *testing.T) {
+		token, bodies = "expired", nil
+		rmock.ResetCalls()
+		refreshes := 0
+		h := RefreshOn401(func(ctx context.Context) error {
+			refreshes++
+			return nil
+		})(auth(rmock))
+
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, 1, refreshes)
+		assert.Equal(t, 2, rmock.Calls(), "repeated once only")
+	})
+
+	t.Run("body not replayable", func(t *testing.T) {
+		token, bodies = "expired", nil
+		rmock.ResetCalls()
+		refreshes := 0
+		h := RefreshOn401(func(ctx context.Context) error {
+			refreshes++
+			return nil
+		})(auth(rmock))
+
+		req, err := http.NewRequest("POST", "http://example.com/blah", io.NopCloser(bytes.NewBufferString("payload")))
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, 0, refreshes)
+		assert.Equal(t, 1, rmock.Calls())
+	})
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// B3 propagation headers, Zipkin-style
+const (
+	B3TraceIDHeader = "X-B3-TraceId"
+	B3SpanIDHeader  = "X-B3-SpanId"
+)
+
+type b3Key struct{}
+
+type b3IDs struct {
+	traceID string
+	spanID  string
+}
+
+// WithB3 returns derived context with B3 trace and span ids, i.e. taken from the inbound request by the handler
+func WithB3(ctx context.Context, traceID, spanID string) context.Context {
+	return context.WithValue(ctx, b3Key{}, b3IDs{traceID: traceID, spanID: spanID})
+}
+
+// B3FromContext returns B3 trace and span ids stored by WithB3 or B3Propagation, empty strings if not set
+func B3FromContext(ctx context.Context) (traceID, spanID string) {
+	ids, _ := ctx.Value(b3Key{}).(b3IDs)
+	return ids.traceID, ids.spanID
+}
+
+// B3Propagation middleware sets X-B3-TraceId and X-B3-SpanId headers from the ids stored in the request context
+// with WithB3, so Zipkin-style tracing continues across hops. If the context has no trace id, new random trace
+// and span ids generated and stored in the request context for the downstream middlewares, i.e. for logging.
+// Headers already set on the request are kept.
+func B3Propagation(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		traceID, spanID := B3FromContext(req.Context())
+		if traceID == "" {
+			traceID, spanID = randomHex(16), randomHex(8)
+			req = req.WithContext(WithB3(req.Context(), traceID, spanID))
+		}
+		if req.Header.Get(B3TraceIDHeader) == "" {
+			req.Header.Set(B3TraceIDHeader, traceID)
+			if spanID != "" {
+				req.Header.Set(B3SpanIDHeader, spanID)
+			}
+		}
+		return next.RoundTrip(req)
+	}
+	return RoundTripperFunc(fn)
+}
+
+// randomHex returns hex-encoded n random bytes
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
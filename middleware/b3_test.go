@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestB3Propagation(t *testing.T) {
+	var traceIDs, spanIDs, ctxTraceIDs []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		traceIDs = append(traceIDs, r.Header.Get("X-B3-TraceId"))
+		spanIDs = append(spanIDs, r.Header.Get("X-B3-SpanId"))
+		traceID, _ := B3FromContext(r.Context())
+		ctxTraceIDs = append(ctxTraceIDs, traceID)
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	h := B3Propagation(rmock)
+
+	ctx := WithB3(context.Background(), "463ac35c9f6413ad48485a3953bb6124", "a2fb4a1d1a96d312")
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-B3-TraceId", "preset")
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, 4, len(traceIDs))
+	assert.Equal(t, "463ac35c9f6413ad48485a3953bb6124", traceIDs[0], "existing trace id propagated")
+	assert.Equal(t, "a2fb4a1d1a96d312", spanIDs[0], "existing span id propagated")
+
+	assert.Len(t, traceIDs[1], 32, "new trace id generated")
+	assert.Len(t, spanIDs[1], 16, "new span id generated")
+	assert.Equal(t, traceIDs[1], ctxTraceIDs[1], "generated trace id stored in context")
+	assert.NotEqual(t, traceIDs[1], traceIDs[2], "unique trace id per request")
+
+	assert.Equal(t, "preset", traceIDs[3], "header set on request kept")
+}
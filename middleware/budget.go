@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// RepeaterRetryBudget limits the number of repeats per time window, shared by Repeater middlewares
+// with RepeaterBudget option. Protects the backend from retry storms during an outage.
+// Tokens refilled continuously, up to maxRetries per window.
+type RepeaterRetryBudget struct {
+	maxRetries float64
+	window     time.Duration
+	now        func() time.Time
+
+	lock    sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// NewRepeaterRetryBudget makes RepeaterRetryBudget allowing up to maxRetries repeats per window, starting full
+func NewRepeaterRetryBudget(maxRetries int, window time.Duration) *RepeaterRetryBudget {
+	return &RepeaterRetryBudget{maxRetries: float64(maxRetries), window: window, now: time.Now,
+		tokens: float64(maxRetries)}
+}
+
+// allow takes a token for a repeat, returns false if the budget exhausted
+func (b *RepeaterRetryBudget) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	if !b.updated.IsZero() && b.window > 0 {
+		b.tokens += float64(now.Sub(b.updated)) / float64(b.window) * b.maxRetries
+		if b.tokens > b.maxRetries {
+			b.tokens = b.maxRetries
+		}
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestRepeater_Budget(t *testing.T) {
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+			for _, e := range errs {
+				if errors.Is(err, e) {
+					return err
+				}
+			}
+		}
+		return err
+	}}
+	failWithErr := false
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if failWithErr {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil
+	}}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	budget := NewRepeaterRetryBudget(3, time.Minute)
+	budget.now = func() time.Time { return now }
+
+	// two chains sharing the budget
+	h1 := RepeaterWithOptions(repeater, RepeaterBudget(budget))(rmock)
+	h2 := RepeaterWithOptions(repeater, RepeaterBudget(budget))(rmock)
+
+	attempts := func(h http.RoundTripper) (int, *http.Response, error) {
+		rmock.ResetCalls()
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		return rmock.Calls(), resp, err
+	}
+
+	n, resp, err := attempts(h1)
+	require.NoError(t, err, "budget drained, the failed response returned")
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, 4, n, "first attempt and 3 repeats")
+
+	n, resp, err = attempts(h2)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, 1, n, "single attempt with exhausted budget")
+
+	failWithErr = true
+	n, _, err = attempts(h1)
+	require.EqualError(t, err, "repeater: connection refused")
+	assert.Equal(t, 1, n)
+	failWithErr = false
+
+	now = now.Add(25 * time.Second) // a bit more than a third of the window refills one token
+	n, _, _ = attempts(h1)
+	assert.Equal(t, 2, n)
+
+	now = now.Add(time.Hour) // refilled up to the max
+	n, _, _ = attempts(h2)
+	assert.Equal(t, 4, n)
+
+	n, _, err = attempts(RepeaterWithOptions(repeater)(rmock))
+	require.Error(t, err)
+	assert.Equal(t, 5, n, "no budget by default")
+}
+
+func TestRepeater_BudgetSpentOnRepeatsOnly(t *testing.T) {
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 3; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 503, Status: "503 Service Unavailable", Body: http.NoBody}, nil
+	}}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	budget := NewRepeaterRetryBudget(10, time.Minute)
+	budget.now = func() time.Time { return now }
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = RepeaterWithOptions(repeater, RepeaterBudget(budget), RepeaterFailOnCodes(503))(rmock).RoundTrip(req)
+	var rerr *RepeaterError
+	require.True(t, errors.As(err, &rerr), "repeats exhausted")
+	assert.Equal(t, 3, rerr.Attempts)
+	assert.Equal(t, 3, rmock.Calls())
+
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	assert.Equal(t, float64(8), budget.tokens, "tokens spent for 2 repeats, not for the last failed attempt")
+}
@@ -2,15 +2,19 @@
 package cache
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-pkgz/requester/middleware"
 )
@@ -20,9 +24,28 @@ type Middleware struct {
 	Service
 
 	allowedMethods []string
+	contentTypes   []string
+	stale          staleCache
+	statusHeader   string
+	ttlHeader      string
+	allowSetCookie bool
+	cacheIf        func(resp *http.Response) bool
+	legacyDump     bool
+	compress       bool
+	fallbackOnErr  bool
+	headFromGet    bool
+	onError        func(err error)
 	keyFunc        func(r *http.Request) string
+	keyHash        func(key []byte) string
+	now            func() time.Time
 	keyComponents  struct {
-		body    bool
+		body        bool
+		bodyMethods []string
+		bodyLimit   int
+		query       struct {
+			normalize bool
+			ignore    []string
+		}
 		headers struct {
 			enabled bool
 			include []string
@@ -35,11 +58,22 @@ type Middleware struct {
 
 const maxBodySize = 1024 * 16
 
-// Service defines loading cache interface to be used for caching, matching github.com/go-pkgz/lcw interface
+// errNotCacheable returned by the loading function to skip storing of the response
+var errNotCacheable = errors.New("response not cacheable")
+
+// Service defines loading cache interface to be used for caching, matching github.com/go-pkgz/lcw interface.
+// Responses stored as []byte values, Get should return them as-is. Other types fail the request.
 type Service interface {
 	Get(key string, fn func() (interface{}, error)) (interface{}, error)
 }
 
+// TTLService is an optional extension of Service storing entries with individual TTL, used by TTLFromHeader and WithTTL.
+// The loading function returns the value with its TTL, zero TTL means the default one of the service.
+type TTLService interface {
+	Service
+	GetWithTTL(key string, fn func() (interface{}, time.Duration, error)) (interface{}, error)
+}
+
 // ServiceFunc is an adapter to allow the use of an ordinary functions as the loading cache.
 type ServiceFunc func(key string, fn func() (interface{}, error)) (interface{}, error)
 
@@ -48,10 +82,31 @@ func (c ServiceFunc) Get(key string, fn func() (interface{}, error)) (interface{
 	return c(key, fn)
 }
 
+type bypassKey struct{}
+
+// Bypass returns derived context disabling caching, both read and write, for requests made with it
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+func bypassed(ctx context.Context) bool {
+	v, _ := ctx.Value(bypassKey{}).(bool)
+	return v
+}
+
+type ttlKey struct{}
+
+// WithTTL returns derived context overriding TTL of the entry stored for requests made with it.
+// Requires the Service to implement TTLService, ignored otherwise. Takes precedence over TTLFromHeader.
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey{}, ttl)
+}
+
 // New makes cache middleware for given cache.Service and optional set of params
 // By default allowed methods limited to GET only and key for request's URL
 func New(svc Service, opts ...func(m *Middleware)) *Middleware {
-	res := Middleware{Service: svc, allowedMethods: []string{"GET"}}
+	res := Middleware{Service: svc, allowedMethods: []string{"GET"}, now: time.Now}
+	res.keyComponents.bodyLimit = maxBodySize
 	for _, opt := range opts {
 		opt(&res)
 	}
@@ -64,7 +119,11 @@ func New(svc Service, opts ...func(m *Middleware)) *Middleware {
 func (m *Middleware) Middleware(next http.RoundTripper) http.RoundTripper {
 	fn := func(req *http.Request) (resp *http.Response, err error) {
 
-		if m.Service == nil || !m.methodCacheable(req) {
+		if m.Service != nil && m.headFromGet && req.Method == http.MethodHead && !bypassed(req.Context()) {
+			return m.headFromCache(next, req)
+		}
+
+		if m.Service == nil || !m.methodCacheable(req) || bypassed(req.Context()) {
 			return next.RoundTrip(req)
 		}
 
@@ -73,44 +132,229 @@ func (m *Middleware) Middleware(next http.RoundTripper) http.RoundTripper {
 			return nil, fmt.Errorf("cache key: %w", e)
 		}
 
-		cachedResp, e := m.Get(key, func() (interface{}, error) {
-			resp, err = next.RoundTrip(req)
-			if err != nil {
-				return nil, err
+		var staleBody []byte
+		fetched := false
+		cachedResp, e := m.load(key, func() (interface{}, time.Duration, error) {
+			if data, ok := m.staleData(next, req, key); ok {
+				staleBody = data
+				return nil, 0, errStale
 			}
-			if resp.Body == nil {
-				return nil, nil
+			fetched = true
+			var data interface{}
+			resp, data, err = m.fetch(next, req)
+			ttl := m.entryTTL(req, resp)
+			if err == nil && data != nil {
+				m.keepStale(key, data.([]byte), ttl)
 			}
-			return httputil.DumpResponse(resp, true)
+			return data, ttl, err
 		})
 
+		if errors.Is(e, errStale) {
+			resp, err = decodeResponse(staleBody, req)
+			return m.withStatus(resp, err, "STALE")
+		}
+		if errors.Is(e, errNotCacheable) {
+			return m.withStatus(resp, nil, "MISS") // response fetched but not stored
+		}
 		if e != nil {
-			return nil, fmt.Errorf("cache read for %s: %w", key, e)
+			if fetched && err != nil { // request failed, not the cache
+				return nil, fmt.Errorf("cache read for %s: %w", key, e)
+			}
+			return m.serviceFailed(next, req, resp, fmt.Errorf("cache read for %s: %w", key, e))
 		}
 
-		body := cachedResp.([]byte)
-		return http.ReadResponse(bufio.NewReader(bytes.NewReader(body)), req)
+		body, ok := cachedResp.([]byte)
+		if !ok {
+			return m.serviceFailed(next, req, resp, fmt.Errorf("cache: unexpected stored type %T for %s, expected []byte", cachedResp, key))
+		}
+		resp, err = decodeResponse(body, req)
+		if fetched {
+			return m.withStatus(resp, err, "MISS")
+		}
+		return m.withStatus(resp, err, "HIT")
 	}
 	return middleware.RoundTripperFunc(fn)
 }
 
+// headFromCache serves HEAD request with status and headers of the cached GET response for the same url.
+// Without the cached GET, or with GET not allowed for caching, the request passed to next, the response is not stored.
+// Each served response gets its own copy of the headers decoded from the entry.
+func (m *Middleware) headFromCache(next http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	getReq := req.WithContext(req.Context())
+	getReq.Method = http.MethodGet
+	getReq.Header = req.Header.Clone()
+	if !m.methodCacheable(getReq) {
+		return next.RoundTrip(req)
+	}
+	key, e := m.extractCacheKey(getReq)
+	if e != nil {
+		return nil, fmt.Errorf("cache key: %w", e)
+	}
+
+	fetched := false
+	cachedResp, e := m.Get(key, func() (interface{}, error) {
+		fetched = true
+		if resp, err = next.RoundTrip(req); err != nil {
+			return nil, err
+		}
+		return nil, errNotCacheable // HEAD response has no body, can't be served for GET
+	})
+	if errors.Is(e, errNotCacheable) {
+		return m.withStatus(resp, nil, "MISS")
+	}
+	if e != nil {
+		if fetched && err != nil {
+			return nil, err
+		}
+		return m.serviceFailed(next, req, resp, fmt.Errorf("cache read for %s: %w", key, e))
+	}
+
+	body, ok := cachedResp.([]byte)
+	if !ok {
+		return m.serviceFailed(next, req, resp, fmt.Errorf("cache: unexpected stored type %T for %s, expected []byte", cachedResp, key))
+	}
+	if resp, err = decodeResponse(body, req); err != nil {
+		return nil, err
+	}
+	resp.Header = resp.Header.Clone()
+	resp.Body = http.NoBody
+	return m.withStatus(resp, nil, "HIT")
+}
+
+// load gets the value from the cache service. With the service implementing TTLService the entry stored
+// with TTL returned by fn, otherwise the TTL ignored.
+func (m *Middleware) load(key string, fn func() (interface{}, time.Duration, error)) (interface{}, error) {
+	if ts, ok := m.Service.(TTLService); ok {
+		return ts.GetWithTTL(key, fn)
+	}
+	return m.Get(key, func() (interface{}, error) {
+		v, _, err := fn()
+		return v, err
+	})
+}
+
+// entryTTL returns TTL of the entry set by WithTTL or by the response's ttlHeader, zero for the default one
+func (m *Middleware) entryTTL(req *http.Request, resp *http.Response) time.Duration {
+	if ttl, ok := req.Context().Value(ttlKey{}).(time.Duration); ok && ttl > 0 {
+		return ttl
+	}
+	return m.responseTTL(resp)
+}
+
+// responseTTL returns TTL set by the response's ttlHeader in seconds, zero if not set or invalid
+func (m *Middleware) responseTTL(resp *http.Response) time.Duration {
+	if m.ttlHeader == "" || resp == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get(m.ttlHeader))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// serviceFailed reports the error of the cache service to OnError hook. With FallbackOnError returns the response
+// if already fetched or makes the request directly, otherwise returns the error.
+func (m *Middleware) serviceFailed(next http.RoundTripper, req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	if m.onError != nil {
+		m.onError(err)
+	}
+	if !m.fallbackOnErr {
+		return nil, err
+	}
+	if resp == nil {
+		resp, err = next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.withStatus(resp, nil, "MISS")
+}
+
+// withStatus sets cache status header on the response if enabled
+func (m *Middleware) withStatus(resp *http.Response, err error, status string) (*http.Response, error) {
+	if err != nil || m.statusHeader == "" {
+		return resp, err
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set(m.statusHeader, status)
+	return resp, nil
+}
+
+// fetch makes the request and dumps the response for storing.
+// Returns errNotCacheable with the response if it should not be stored.
+func (m *Middleware) fetch(next http.RoundTripper, req *http.Request) (*http.Response, interface{}, error) {
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !m.responseCacheable(resp) {
+		return resp, nil, errNotCacheable
+	}
+	if m.cacheIf != nil {
+		ok, e := m.approved(resp)
+		if e != nil {
+			return nil, nil, e
+		}
+		if !ok {
+			return resp, nil, errNotCacheable
+		}
+	}
+	data, err := m.encodeResponse(resp)
+	return resp, data, err
+}
+
+// approved checks the response with CacheIf predicate. The body buffered, so the predicate can read it,
+// and restored after the check.
+func (m *Middleware) approved(resp *http.Response) (bool, error) {
+	if resp.Body == nil {
+		return m.cacheIf(resp), nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("read response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	ok := m.cacheIf(resp)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return ok, nil
+}
+
+// Key returns the caching key the middleware uses for the request, i.e. to warm up or invalidate entries
+// of the Service directly. The request's body, if a part of the key, restored for the caller.
+func (m *Middleware) Key(req *http.Request) (string, error) {
+	return m.extractCacheKey(req)
+}
+
 func (m *Middleware) extractCacheKey(req *http.Request) (key string, err error) {
 
 	bodyKey := func() (string, error) {
-		if req.Body == nil {
+		if req.Body == nil || req.Body == http.NoBody {
 			return "", nil
 		}
-		reqBody, e := io.ReadAll(io.LimitReader(req.Body, maxBodySize))
+		limit := m.keyComponents.bodyLimit
+		reqBody, e := io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
 		if e != nil {
 			return "", e
 		}
-		_ = req.Body.Close()
-		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+		if len(reqBody) > limit {
+			// restore the body, including the part beyond the limit
+			req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(reqBody), req.Body), Closer: req.Body}
+			return string(reqBody[:limit]), nil
+		}
+		// the whole body read, keep it replayable for the next middlewares, i.e. Repeater
+		req.Body = readCloser{Reader: bytes.NewReader(reqBody), Closer: req.Body}
+		if req.GetBody == nil {
+			req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(reqBody)), nil }
+		}
 		return string(reqBody), nil
 	}
 
 	bkey := ""
-	if m.keyComponents.body && m.keyFunc == nil {
+	if m.bodyInKey(req) && m.keyFunc == nil {
 		bkey, err = bodyKey()
 	}
 
@@ -129,15 +373,78 @@ func (m *Middleware) extractCacheKey(req *http.Request) (key string, err error)
 	if m.keyFunc != nil {
 		key = m.keyFunc(req)
 	} else {
-		key = fmt.Sprintf("%s##%s##%v##%s", req.URL.String(), req.Method, hkey, bkey)
+		key = fmt.Sprintf("%s##%s##%v##%s", m.urlKey(req), req.Method, hkey, bkey)
 	}
 	if m.dbg { // dbg for testing only, keeps the key human-readable
 		return key, nil
 	}
 
+	if m.keyHash != nil {
+		return m.keyHash([]byte(key)), err
+	}
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(key))), err
 }
 
+// urlKey returns the request's url for the key, with query parameters sorted by NormalizeQuery and without
+// ignored ones. The request's url is not changed.
+func (m *Middleware) urlKey(req *http.Request) string {
+	qc := m.keyComponents.query
+	if !qc.normalize && len(qc.ignore) == 0 {
+		return req.URL.String()
+	}
+	u := *req.URL
+	if qc.normalize {
+		q := u.Query()
+		for _, p := range qc.ignore {
+			q.Del(p)
+		}
+		u.RawQuery = q.Encode() // sorted by key
+		return u.String()
+	}
+
+	// drop ignored parameters keeping the order of others
+	kept := []string{}
+	for _, p := range strings.Split(u.RawQuery, "&") {
+		name := p
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			name = p[:i]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if !m.queryParamIgnored(name) {
+			kept = append(kept, p)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
+
+func (m *Middleware) queryParamIgnored(name string) bool {
+	for _, p := range m.keyComponents.query.ignore {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyInKey checks if the request's body should be a part of the key, for all methods or the configured ones only
+func (m *Middleware) bodyInKey(req *http.Request) bool {
+	if !m.keyComponents.body {
+		return false
+	}
+	if len(m.keyComponents.bodyMethods) == 0 {
+		return true
+	}
+	for _, method := range m.keyComponents.bodyMethods {
+		if strings.EqualFold(method, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Middleware) headerAllowed(key string) bool {
 	if !m.keyComponents.headers.enabled {
 		return false
@@ -170,3 +477,28 @@ func (m *Middleware) methodCacheable(req *http.Request) bool {
 	}
 	return false
 }
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// responseCacheable checks if response allowed to be stored
+func (m *Middleware) responseCacheable(resp *http.Response) bool {
+	if !m.allowSetCookie && len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false // may leak one user's session to another
+	}
+	if len(m.contentTypes) == 0 {
+		return true
+	}
+	ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range m.contentTypes {
+		if strings.EqualFold(t, ct) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,25 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/go-pkgz/requester/middleware"
 	"github.com/go-pkgz/requester/middleware/mocks"
 )
 
@@ -116,6 +126,129 @@ func Test_extractCacheKey(t *testing.T) {
 
 }
 
+func Test_extractCacheKeyWithHash(t *testing.T) {
+	var calls int32
+	fnvHash := func(key []byte) string {
+		atomic.AddInt32(&calls, 1)
+		h := fnv.New64a()
+		_, _ = h.Write(key)
+		return strconv.FormatUint(h.Sum64(), 16)
+	}
+	c := New(nil, KeyHash(fnvHash))
+
+	req, err := http.NewRequest("GET", "http://example.com/1/2?k1=v1&k2=v2", http.NoBody)
+	require.NoError(t, err)
+	key1, err := c.extractCacheKey(req)
+	require.NoError(t, err)
+	key2, err := c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.Equal(t, key1, key2, "stable key for the same request")
+	assert.Equal(t, "f5c7b275bc71f220", key1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	req, err = http.NewRequest("GET", "http://example.com/1/2?k1=v1&k2=v3", http.NoBody)
+	require.NoError(t, err)
+	key3, err := c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.NotEqual(t, key1, key3)
+
+	c.dbg = true
+	keyDbg, err := c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/1/2?k1=v1&k2=v3##GET####", keyDbg, "dbg key not hashed")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func Test_extractCacheKeyBodyLimit(t *testing.T) {
+	makeReq := func(body string) *http.Request {
+		res, err := http.NewRequest("POST", "http://example.com/1", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return res
+	}
+
+	t.Run("small limit", func(t *testing.T) {
+		c := New(nil, KeyWithBody, KeyBodyLimit(8))
+		req1, req2 := makeReq("12345678-aaa"), makeReq("12345678-bbb")
+		key1, err := c.extractCacheKey(req1)
+		require.NoError(t, err)
+		key2, err := c.extractCacheKey(req2)
+		require.NoError(t, err)
+		assert.Equal(t, key1, key2, "bodies differ beyond the limit")
+
+		body, err := io.ReadAll(req1.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "12345678-aaa", string(body), "body fully readable")
+	})
+
+	t.Run("large limit", func(t *testing.T) {
+		c := New(nil, KeyWithBody, KeyBodyLimit(1024))
+		req1, req2 := makeReq("12345678-aaa"), makeReq("12345678-bbb")
+		key1, err := c.extractCacheKey(req1)
+		require.NoError(t, err)
+		key2, err := c.extractCacheKey(req2)
+		require.NoError(t, err)
+		assert.NotEqual(t, key1, key2)
+
+		body, err := io.ReadAll(req2.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "12345678-bbb", string(body))
+	})
+
+	t.Run("negative limit", func(t *testing.T) {
+		c := New(nil, KeyWithBody, KeyBodyLimit(-1))
+		req1, req2 := makeReq("12345678-aaa"), makeReq("12345678-bbb")
+		key1, err := c.extractCacheKey(req1)
+		require.NoError(t, err)
+		key2, err := c.extractCacheKey(req2)
+		require.NoError(t, err)
+		assert.Equal(t, key1, key2, "treated as zero limit")
+
+		body, err := io.ReadAll(req1.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "12345678-aaa", string(body), "body fully readable")
+	})
+}
+
+func Test_extractCacheKeyBodyForMethods(t *testing.T) {
+	c := New(nil, KeyWithBodyForMethods("POST", "put"))
+	c.dbg = true
+
+	makeReq := func(method, body string) *http.Request {
+		res, err := http.NewRequest(method, "http://example.com/1", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return res
+	}
+
+	req := makeReq("POST", "something")
+	key, err := c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/1##POST####something", key)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "something", string(body))
+
+	key, err = c.extractCacheKey(makeReq("PUT", "something"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/1##PUT####something", key)
+
+	req = makeReq("GET", "something")
+	reqBody := req.Body
+	key, err = c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/1##GET####", key)
+	assert.Equal(t, reqBody, req.Body, "body not read")
+
+	c = New(nil, KeyWithBodyForMethods("POST"), KeyBodyLimit(4))
+	c.dbg = true
+	req = makeReq("POST", "something")
+	key, err = c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/1##POST####some", key)
+	body, err = io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "something", string(body), "body fully readable")
+}
+
 func TestMiddleware_Handle(t *testing.T) {
 
 	cacheMock := mocks.CacheSvc{GetFunc: func(key string, fn func() (interface{}, error)) (interface{}, error) {
@@ -188,3 +321,1049 @@ func TestMiddleware_HandleMethodDisabled(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Equal(t, 1, len(cacheMock.GetCalls()))
 }
+
+func TestMiddleware_Bypass(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	svc := newMemCache()
+	c := New(svc)
+	client := http.Client{Transport: c.Middleware(http.DefaultTransport)}
+
+	get := func(ctx context.Context) {
+		req, err := http.NewRequestWithContext(ctx, "GET", ts.URL, http.NoBody)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(v))
+	}
+
+	get(Bypass(context.Background()))
+	assert.Equal(t, 0, svc.size(), "bypassed response not stored")
+	get(context.Background())
+	get(context.Background())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	get(Bypass(context.Background()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits), "bypassed request not served from cache")
+}
+
+func TestMiddleware_CacheStatusHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	svc := newMemCache()
+	c := New(svc, WithCacheStatusHeader(""), CacheContentTypes("text/plain"))
+	client := http.Client{Transport: c.Middleware(http.DefaultTransport)}
+
+	status := func(ct string) string {
+		resp, err := client.Get(ts.URL + "?ct=" + ct)
+		require.NoError(t, err)
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(v))
+		return resp.Header.Get("X-Cache")
+	}
+
+	assert.Equal(t, "MISS", status("text/plain"))
+	assert.Equal(t, "HIT", status("text/plain"))
+	assert.Equal(t, "MISS", status("text/html"), "not cacheable")
+	assert.Equal(t, "MISS", status("text/html"), "not cacheable")
+
+	c = New(svc)
+	client = http.Client{Transport: c.Middleware(http.DefaultTransport)}
+	assert.Equal(t, "", status("text/plain"), "disabled by default")
+}
+
+func TestMiddleware_SetCookie(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	get := func(client http.Client) {
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "session=secret", resp.Header.Get("Set-Cookie"))
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(v))
+	}
+
+	client := http.Client{Transport: New(newMemCache()).Middleware(http.DefaultTransport)}
+	get(client)
+	get(client)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "response with cookie not cached by default")
+
+	atomic.StoreInt32(&hits, 0)
+	client = http.Client{Transport: New(newMemCache(), AllowSetCookieCaching).Middleware(http.DefaultTransport)}
+	get(client)
+	get(client)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "response with cookie cached")
+}
+
+func TestMiddleware_CacheContentTypes(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	c := New(newMemCache(), CacheContentTypes("application/json"))
+	client := http.Client{Transport: c.Middleware(http.DefaultTransport)}
+
+	get := func(ct string) {
+		resp, err := client.Get(ts.URL + "?ct=" + url.QueryEscape(ct))
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(v))
+	}
+
+	get("application/json; charset=utf-8")
+	get("application/json; charset=utf-8")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "json response cached")
+
+	get("text/html")
+	get("text/html")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits), "html response not cached")
+}
+
+// memCache is a simple in-memory loading cache, errors are not stored
+type memCache struct {
+	sync.Mutex
+	data map[string]interface{}
+}
+
+func newMemCache() *memCache {
+	return &memCache{data: map[string]interface{}{}}
+}
+
+func (c *memCache) Get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	c.Lock()
+	v, ok := c.data[key]
+	c.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.data[key] = v
+	c.Unlock()
+	return v, nil
+}
+
+func TestMiddleware_StaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		if n > 1 {
+			time.Sleep(200 * time.Millisecond) // slow refresh
+		}
+		_, err := w.Write([]byte("resp-" + strconv.Itoa(int(n))))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	svc := newMemCache()
+	c := New(svc, StaleWhileRevalidate(time.Minute, time.Minute))
+	client := http.Client{Transport: c.Middleware(http.DefaultTransport)}
+
+	get := func() string {
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	assert.Equal(t, "resp-1", get())
+	svc.purge() // expire all entries
+
+	st := time.Now()
+	assert.Equal(t, "resp-1", get(), "stale response served")
+	assert.Equal(t, "resp-1", get(), "stale response served while refreshing")
+	assert.Less(t, int64(time.Since(st)), int64(100*time.Millisecond), "stale hit returned without waiting for refresh")
+
+	assert.Eventually(t, func() bool { return svc.size() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "resp-2", get(), "refreshed response served")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "single background fetch")
+}
+
+func TestMiddleware_StaleWindowExpired(t *testing.T) {
+	type syncKey struct{}
+	var hits int32
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if r.Context().Value(syncKey{}) == nil {
+			return nil, errors.New("refresh failed") // background refresh never completes
+		}
+		n := atomic.AddInt32(&hits, 1)
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("resp-" + strconv.Itoa(int(n))))}, nil
+	}}
+
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc := newMemCache()
+	h := New(svc, StaleWhileRevalidate(time.Minute, time.Minute), WithClock(clk.Now)).Middleware(rmock)
+
+	get := func() string {
+		ctx := context.WithValue(context.Background(), syncKey{}, true)
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	assert.Equal(t, "resp-1", get())
+	svc.purge()
+	assert.Equal(t, "resp-1", get(), "stale response served before ttl")
+	clk.add(time.Minute + 59*time.Second)
+	assert.Equal(t, "resp-1", get(), "stale response served within the window")
+	clk.add(2 * time.Second)
+	assert.Equal(t, "resp-2", get(), "window passed, fetched")
+}
+
+func TestMiddleware_StaleLongExpired(t *testing.T) {
+	var hits int32
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&hits, 1)
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("resp-" + strconv.Itoa(int(n))))}, nil
+	}}
+
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc := newMemCache()
+	c := New(svc, StaleWhileRevalidate(time.Minute, time.Minute), WithClock(clk.Now))
+	h := c.Middleware(rmock)
+
+	get := func(url string) string {
+		req, err := http.NewRequest("GET", url, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		v, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	assert.Equal(t, "resp-1", get("http://example.com/1"))
+	assert.Equal(t, "resp-2", get("http://example.com/2"))
+	clk.add(7 * 24 * time.Hour)
+	svc.purge()
+	assert.Equal(t, "resp-3", get("http://example.com/1"), "no stale response a week after ttl and window passed")
+	assert.Equal(t, "resp-4", get("http://example.com/3"))
+
+	req, err := http.NewRequest("GET", "http://example.com/2", http.NoBody)
+	require.NoError(t, err)
+	key, err := c.Key(req)
+	require.NoError(t, err)
+	c.stale.lock.Lock()
+	defer c.stale.lock.Unlock()
+	assert.Equal(t, 2, len(c.stale.items), "expired items removed")
+	_, ok := c.stale.items[key]
+	assert.False(t, ok)
+}
+
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+func (c *memCache) purge() {
+	c.Lock()
+	c.data = map[string]interface{}{}
+	c.Unlock()
+}
+
+func (c *memCache) size() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.data)
+}
+
+func TestMiddleware_Serializer(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: 201, Status: "201 Created", Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+			Header: http.Header{"Content-Type": {"text/plain"}, "X-Multi": {"v1", "v2"}},
+			Body:   io.NopCloser(bytes.NewBufferString("something")), ContentLength: 9}
+		return resp, nil
+	}}
+
+	for _, tt := range []struct {
+		name string
+		opts []func(m *Middleware)
+	}{
+		{name: "binary"},
+		{name: "legacy dump", opts: []func(m *Middleware){LegacyDumpSerializer}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rmock.ResetCalls()
+			svc := newMemCache()
+			h := New(svc, tt.opts...).Middleware(rmock)
+			for i := 0; i < 3; i++ {
+				req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+				require.NoError(t, err)
+				resp, err := h.RoundTrip(req)
+				require.NoError(t, err)
+				assert.Equal(t, 201, resp.StatusCode)
+				assert.Equal(t, "201 Created", resp.Status)
+				assert.Equal(t, "HTTP/1.1", resp.Proto)
+				assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+				assert.Equal(t, []string{"v1", "v2"}, resp.Header.Values("X-Multi"))
+				assert.Equal(t, int64(9), resp.ContentLength)
+				assert.Equal(t, req, resp.Request)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "something", string(body))
+			}
+			assert.Equal(t, 1, rmock.Calls())
+		})
+	}
+
+	t.Run("dumped data read by default", func(t *testing.T) {
+		rmock.ResetCalls()
+		svc := newMemCache()
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = New(svc, LegacyDumpSerializer).Middleware(rmock).RoundTrip(req)
+		require.NoError(t, err)
+
+		resp, err := New(svc).Middleware(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(body))
+		assert.Equal(t, 1, rmock.Calls())
+	})
+
+	t.Run("truncated data", func(t *testing.T) {
+		resp := &http.Response{StatusCode: 200, Status: "200 OK", Header: http.Header{"K": {"v"}},
+			Body: io.NopCloser(bytes.NewBufferString("something"))}
+		data, err := New(nil).encodeResponse(resp)
+		require.NoError(t, err)
+		for i := 1; i < len(data); i++ {
+			_, err = decodeResponse(data[:i], nil)
+			require.Error(t, err, i)
+		}
+		_, err = decodeResponse(data, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("corrupted counts", func(t *testing.T) {
+		head := []byte{entryVersion, 200, 0, 0, 1, 1}
+		huge := binary.AppendUvarint(nil, 1<<62)
+		for _, data := range [][]byte{
+			append(append([]byte{}, head...), huge...),                          // header keys count
+			append(append(append([]byte{}, head...), 1, 1, 'K'), huge...),       // header values count
+			append(append(append([]byte{}, head...), 1, 1, 'K', 1, 1), huge...), // body length
+		} {
+			_, err := decodeResponse(data, nil)
+			require.Error(t, err)
+			assert.ErrorIs(t, err, errTruncated)
+		}
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	resp := &http.Response{StatusCode: 200, Status: "200 OK", Header: http.Header{"K": {"v1", "v2"}},
+		Body: io.NopCloser(bytes.NewBufferString("something"))}
+	data, err := New(nil).encodeResponse(resp)
+	require.NoError(f, err)
+	f.Add(data)
+	f.Add([]byte{entryVersion, 200, 0, 0, 1, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3f})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := decodeResponse(data, nil) // must not panic
+		if err == nil && resp.Body != nil {
+			_, _ = io.ReadAll(resp.Body)
+		}
+	})
+}
+
+func TestMiddleware_CompressEntries(t *testing.T) {
+	payload := strings.Repeat("something compressible ", 10000)
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Status: "200 OK", Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+			Header: http.Header{"Content-Type": {"text/plain"}}, Body: io.NopCloser(strings.NewReader(payload)),
+			ContentLength: int64(len(payload))}, nil
+	}}
+
+	for _, tt := range []struct {
+		name string
+		opts []func(m *Middleware)
+	}{
+		{name: "binary", opts: []func(m *Middleware){CompressEntries}},
+		{name: "legacy dump", opts: []func(m *Middleware){CompressEntries, LegacyDumpSerializer}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rmock.ResetCalls()
+			svc := newMemCache()
+			h := New(svc, tt.opts...).Middleware(rmock)
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+				require.NoError(t, err)
+				resp, err := h.RoundTrip(req)
+				require.NoError(t, err)
+				assert.Equal(t, 200, resp.StatusCode)
+				assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, payload, string(body))
+			}
+			assert.Equal(t, 1, rmock.Calls())
+
+			require.Equal(t, 1, svc.size())
+			for _, v := range svc.data {
+				stored := v.([]byte)
+				t.Logf("stored %d bytes, body %d bytes", len(stored), len(payload))
+				assert.Less(t, len(stored), len(payload)/10, "stored compressed")
+			}
+		})
+	}
+}
+
+func TestMiddleware_UnexpectedStoredType(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("something"))}, nil
+	}}
+	svc := ServiceFunc(func(key string, fn func() (interface{}, error)) (interface{}, error) {
+		return "not bytes", nil
+	})
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = New(svc).Middleware(rmock).RoundTrip(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cache: unexpected stored type string")
+
+	resp, err := New(svc, FallbackOnError).Middleware(rmock).RoundTrip(req)
+	require.NoError(t, err, "treated as cache error")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestMiddleware_NilBody(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 204, Status: "204 No Content"}, nil
+	}}
+	for _, opts := range [][]func(m *Middleware){nil, {LegacyDumpSerializer}} {
+		rmock.ResetCalls()
+		h := New(newMemCache(), opts...).Middleware(rmock)
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			resp, err := h.RoundTrip(req)
+			require.NoError(t, err)
+			assert.Equal(t, 204, resp.StatusCode)
+		}
+		assert.Equal(t, 1, rmock.Calls(), "response without body cached")
+	}
+}
+
+func TestMiddleware_KeyWithBodyRepeater(t *testing.T) {
+	var bodies []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		body := ""
+		if r.Body != nil && r.Body != http.NoBody {
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			body = string(b)
+		}
+		bodies = append(bodies, r.Method+":"+body)
+		if len(bodies)%3 != 0 {
+			return &http.Response{StatusCode: 503, Status: "503 Service Unavailable", Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: 200, Status: "200 OK", Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 3; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+	rpt := middleware.Repeater(repeater, 503)
+	h := New(newMemCache(), Methods("GET", "POST"), KeyWithBody).Middleware(rpt(rmock))
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"GET:", "GET:", "GET:"}, bodies, "all attempts made for request without body")
+
+	bodies = nil
+	req, err = http.NewRequest("POST", "http://example.com/blah", io.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	resp, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"POST:payload", "POST:payload", "POST:payload"}, bodies, "body read for the key replayed")
+}
+
+func BenchmarkMiddleware_Hit(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 100*1024)
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: 200, Status: "200 OK", Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+			Header: http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"max-age=60"}},
+			Body:   io.NopCloser(bytes.NewReader(payload)), ContentLength: int64(len(payload))}
+		return resp, nil
+	}}
+
+	run := func(b *testing.B, opts ...func(m *Middleware)) {
+		h := New(newMemCache(), opts...).Middleware(rmock)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(b, err)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resp, err := h.RoundTrip(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+		}
+	}
+
+	b.Run("binary", func(b *testing.B) { run(b) })
+	b.Run("legacy dump", func(b *testing.B) { run(b, LegacyDumpSerializer) })
+}
+
+func TestMiddleware_FallbackOnError(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("something"))}, nil
+	}}
+	failingSvc := &mocks.CacheSvc{GetFunc: func(key string, fn func() (interface{}, error)) (interface{}, error) {
+		return nil, errors.New("cache is down")
+	}}
+
+	t.Run("error by default", func(t *testing.T) {
+		rmock.ResetCalls()
+		var hookErrs []error
+		h := New(failingSvc, OnError(func(err error) { hookErrs = append(hookErrs, err) })).Middleware(rmock)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "cache is down")
+		require.Equal(t, 1, len(hookErrs))
+		assert.Contains(t, hookErrs[0].Error(), "cache is down")
+		assert.Equal(t, 0, rmock.Calls())
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		rmock.ResetCalls()
+		var hookErrs []error
+		h := New(failingSvc, FallbackOnError, OnError(func(err error) { hookErrs = append(hookErrs, err) })).Middleware(rmock)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(body))
+		assert.Equal(t, 1, len(hookErrs))
+		assert.Equal(t, 1, rmock.Calls())
+	})
+
+	t.Run("fallback, failed after fetch", func(t *testing.T) {
+		rmock.ResetCalls()
+		svc := &mocks.CacheSvc{GetFunc: func(key string, fn func() (interface{}, error)) (interface{}, error) {
+			if _, err := fn(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("can't store")
+		}}
+		h := New(svc, FallbackOnError).Middleware(rmock)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(body))
+		assert.Equal(t, 1, rmock.Calls(), "fetched response returned, no second request")
+	})
+
+	t.Run("request error not a fallback case", func(t *testing.T) {
+		var hookErrs []error
+		failingReq := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return nil, errors.New("request failed")
+		}}
+		h := New(newMemCache(), FallbackOnError, OnError(func(err error) { hookErrs = append(hookErrs, err) })).
+			Middleware(failingReq)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "request failed")
+		assert.Equal(t, 0, len(hookErrs))
+		assert.Equal(t, 1, failingReq.Calls())
+	})
+}
+
+func TestMiddleware_TTLFromHeader(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: 200, Header: http.Header{},
+			Body: io.NopCloser(bytes.NewBufferString(r.URL.Path))}
+		switch r.URL.Path {
+		case "/short":
+			resp.Header.Set("X-Cache-TTL", "10")
+		case "/long":
+			resp.Header.Set("X-Cache-TTL", "300")
+		}
+		return resp, nil
+	}}
+
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc := &ttlCache{now: clk.Now, defaultTTL: time.Minute, data: map[string]ttlEntry{}}
+	h := New(svc, TTLFromHeader("X-Cache-TTL"), WithCacheStatusHeader("")).Middleware(rmock)
+
+	status := func(path string) string {
+		req, err := http.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		return resp.Header.Get("X-Cache")
+	}
+
+	for _, p := range []string{"/short", "/long", "/default"} {
+		assert.Equal(t, "MISS", status(p), p)
+		assert.Equal(t, "HIT", status(p), p)
+	}
+
+	clk.add(30 * time.Second)
+	assert.Equal(t, "MISS", status("/short"), "expired after 10s")
+	assert.Equal(t, "HIT", status("/long"))
+	assert.Equal(t, "HIT", status("/default"))
+
+	clk.add(time.Minute)
+	assert.Equal(t, "HIT", status("/long"))
+	assert.Equal(t, "MISS", status("/default"), "expired after default ttl")
+
+	clk.add(5 * time.Minute)
+	assert.Equal(t, "MISS", status("/long"), "expired after 300s")
+	assert.Equal(t, 6, rmock.Calls())
+
+	t.Run("service without ttl support", func(t *testing.T) {
+		rmock.ResetCalls()
+		h := New(newMemCache(), TTLFromHeader("X-Cache-TTL")).Middleware(rmock)
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest("GET", "http://example.com/short", http.NoBody)
+			require.NoError(t, err)
+			_, err = h.RoundTrip(req)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 1, rmock.Calls())
+	})
+}
+
+// ttlCache is a loading cache with per-entry TTL, implementing TTLService
+type ttlCache struct {
+	sync.Mutex
+	now        func() time.Time
+	defaultTTL time.Duration
+	data       map[string]ttlEntry
+}
+
+type ttlEntry struct {
+	val       interface{}
+	expiresAt time.Time
+}
+
+func (c *ttlCache) Get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return c.GetWithTTL(key, func() (interface{}, time.Duration, error) {
+		v, err := fn()
+		return v, 0, err
+	})
+}
+
+func (c *ttlCache) GetWithTTL(key string, fn func() (interface{}, time.Duration, error)) (interface{}, error) {
+	c.Lock()
+	e, ok := c.data[key]
+	c.Unlock()
+	if ok && c.now().Before(e.expiresAt) {
+		return e.val, nil
+	}
+	v, ttl, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if ttl == 0 {
+		ttl = c.defaultTTL
+	}
+	c.Lock()
+	c.data[key] = ttlEntry{val: v, expiresAt: c.now().Add(ttl)}
+	c.Unlock()
+	return v, nil
+}
+
+func TestMiddleware_NormalizeQuery(t *testing.T) {
+	var urls []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		urls = append(urls, r.URL.String())
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("something"))}, nil
+	}}
+	svc := newMemCache()
+	h := New(svc, NormalizeQuery("timestamp", "nonce")).Middleware(rmock)
+
+	for _, u := range []string{"http://example.com/blah?a=1&b=2", "http://example.com/blah?b=2&a=1",
+		"http://example.com/blah?timestamp=123&b=2&a=1&nonce=xyz", "http://example.com/blah?a=2&b=1"} {
+		req, err := http.NewRequest("GET", u, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(body))
+		assert.Equal(t, u, req.URL.String(), "request url not changed")
+	}
+	assert.Equal(t, []string{"http://example.com/blah?a=1&b=2", "http://example.com/blah?a=2&b=1"}, urls,
+		"reordered and dropped params hit the same entry, fetched with the original url")
+	assert.Equal(t, 2, svc.size())
+
+	c := New(nil, NormalizeQuery())
+	c.dbg = true
+	req, err := http.NewRequest("GET", "http://example.com/blah?z=1&a=2&a=1", http.NoBody)
+	require.NoError(t, err)
+	key, err := c.extractCacheKey(req)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/blah?a=2&a=1&z=1##GET####", key)
+}
+
+func TestMiddleware_CacheIgnoreParams(t *testing.T) {
+	var urls []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		urls = append(urls, r.URL.String())
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("something"))}, nil
+	}}
+	svc := newMemCache()
+	h := New(svc, CacheIgnoreParams("utm_source", "_")).Middleware(rmock)
+
+	for _, u := range []string{"http://example.com/blah?a=1&utm_source=x", "http://example.com/blah?a=1&utm_source=y&_=123",
+		"http://example.com/blah?_=456&a=1", "http://example.com/blah?a=2&utm_source=x"} {
+		req, err := http.NewRequest("GET", u, http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, u, req.URL.String(), "request url not changed")
+	}
+	assert.Equal(t, []string{"http://example.com/blah?a=1&utm_source=x", "http://example.com/blah?a=2&utm_source=x"}, urls,
+		"ignored params don't fragment the cache, other params do")
+	assert.Equal(t, 2, svc.size())
+
+	tbl := []struct {
+		opts []func(m *Middleware)
+		url  string
+		key  string
+	}{
+		{[]func(m *Middleware){CacheIgnoreParams("utm_source")}, "http://example.com/blah?z=1&utm_source=x&a=1",
+			"http://example.com/blah?z=1&a=1##GET####"},
+		{[]func(m *Middleware){CacheIgnoreParams("utm_source")}, "http://example.com/blah?utm_source=x",
+			"http://example.com/blah##GET####"},
+		{[]func(m *Middleware){CacheIgnoreParams("utm source")}, "http://example.com/blah?utm+source=x&a=1",
+			"http://example.com/blah?a=1##GET####"},
+		{[]func(m *Middleware){CacheIgnoreParams("utm_source"), NormalizeQuery("nonce")},
+			"http://example.com/blah?z=1&utm_source=x&nonce=1&a=1", "http://example.com/blah?a=1&z=1##GET####"},
+		{[]func(m *Middleware){NormalizeQuery(), CacheIgnoreParams("utm_source")},
+			"http://example.com/blah?z=1&utm_source=x&a=1", "http://example.com/blah?a=1&z=1##GET####"},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c := New(nil, tt.opts...)
+			c.dbg = true
+			req, err := http.NewRequest("GET", tt.url, http.NoBody)
+			require.NoError(t, err)
+			key, err := c.extractCacheKey(req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.key, key)
+		})
+	}
+}
+
+func TestMiddleware_WithTTL(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Header: http.Header{"X-Cache-Ttl": {"600"}},
+			Body: io.NopCloser(bytes.NewBufferString(r.URL.Path))}, nil
+	}}
+
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	svc := &ttlCache{now: clk.Now, defaultTTL: time.Minute, data: map[string]ttlEntry{}}
+	h := New(svc, WithCacheStatusHeader("")).Middleware(rmock)
+
+	status := func(ctx context.Context, path string) string {
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com"+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		return resp.Header.Get("X-Cache")
+	}
+
+	short := WithTTL(context.Background(), 10*time.Second)
+	assert.Equal(t, "MISS", status(short, "/short"))
+	assert.Equal(t, "MISS", status(context.Background(), "/default"))
+	assert.Equal(t, "HIT", status(context.Background(), "/short"), "ttl used on store only")
+
+	clk.add(30 * time.Second)
+	assert.Equal(t, "MISS", status(context.Background(), "/short"), "expired after 10s")
+	assert.Equal(t, "HIT", status(context.Background(), "/default"))
+
+	clk.add(time.Minute)
+	assert.Equal(t, "MISS", status(context.Background(), "/default"), "expired after default ttl")
+	assert.Equal(t, 4, rmock.Calls())
+
+	t.Run("overrides ttl header", func(t *testing.T) {
+		rmock.ResetCalls()
+		h = New(svc, TTLFromHeader("X-Cache-TTL"), WithCacheStatusHeader("")).Middleware(rmock)
+		assert.Equal(t, "MISS", status(WithTTL(context.Background(), 10*time.Second), "/override"))
+		assert.Equal(t, "MISS", status(context.Background(), "/header"))
+		clk.add(5 * time.Minute)
+		assert.Equal(t, "MISS", status(context.Background(), "/override"))
+		assert.Equal(t, "HIT", status(context.Background(), "/header"), "600s from header")
+	})
+}
+
+func TestMiddleware_CacheIf(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(bytes.NewBufferString("something"))}
+		switch r.URL.Path {
+		case "/empty":
+			resp.Body = io.NopCloser(bytes.NewBufferString(""))
+			resp.Header.Set("X-Cacheable", "yes")
+		case "/no-header":
+		default:
+			resp.Header.Set("X-Cacheable", "yes")
+		}
+		return resp, nil
+	}}
+	svc := newMemCache()
+	h := New(svc, CacheIf(func(resp *http.Response) bool {
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return len(body) > 0 && resp.Header.Get("X-Cacheable") == "yes"
+	})).Middleware(rmock)
+
+	get := func(path string) string {
+		req, err := http.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "something", get("/ok"))
+		assert.Equal(t, "", get("/empty"))
+		assert.Equal(t, "something", get("/no-header"), "body restored after the predicate")
+	}
+	assert.Equal(t, 1+3+3, rmock.Calls(), "responses failing the predicate fetched each time")
+	assert.Equal(t, 1, svc.size())
+}
+
+func TestMiddleware_HeadFromGet(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: 200, Header: http.Header{"X-Method": {r.Method}, "Content-Type": {"text/plain"}},
+			Body: io.NopCloser(bytes.NewBufferString("something")), ContentLength: 9}
+		if r.Method == http.MethodHead {
+			resp.Body = http.NoBody
+		}
+		return resp, nil
+	}}
+	svc := newMemCache()
+	h := New(svc, HeadFromGet, WithCacheStatusHeader("")).Middleware(rmock)
+
+	do := func(method, path string) (*http.Response, string) {
+		req, err := http.NewRequest(method, "http://example.com"+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := do("GET", "/blah")
+	assert.Equal(t, "something", body)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+
+	rmock.ResetCalls()
+	resp, body = do("HEAD", "/blah")
+	assert.Equal(t, 0, rmock.Calls(), "served from cached GET")
+	assert.Equal(t, "", body)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "GET", resp.Header.Get("X-Method"))
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	assert.Equal(t, http.MethodHead, resp.Request.Method)
+
+	resp, body = do("HEAD", "/other")
+	assert.Equal(t, 1, rmock.Calls(), "no cached GET, HEAD sent")
+	assert.Equal(t, "HEAD", resp.Header.Get("X-Method"))
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+	assert.Equal(t, "", body)
+
+	resp, body = do("GET", "/other")
+	assert.Equal(t, 2, rmock.Calls(), "HEAD response not stored for GET")
+	assert.Equal(t, "something", body)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+
+	resp, _ = do("HEAD", "/blah")
+	resp.Header.Set("X-Method", "changed")
+	resp, _ = do("HEAD", "/blah")
+	assert.Equal(t, "GET", resp.Header.Get("X-Method"), "headers not shared between responses")
+
+	rmock.ResetCalls()
+	h = New(svc).Middleware(rmock)
+	_, _ = do("HEAD", "/blah")
+	assert.Equal(t, 1, rmock.Calls(), "HEAD not served from GET without the option")
+
+	rmock.ResetCalls()
+	h = New(svc, HeadFromGet, Methods("POST")).Middleware(rmock)
+	resp, _ = do("HEAD", "/blah")
+	assert.Equal(t, 1, rmock.Calls(), "HEAD not served from GET with GET not allowed")
+	assert.Equal(t, "HEAD", resp.Header.Get("X-Method"))
+}
+
+func TestMiddleware_Key(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("something"))}, nil
+	}}
+	var keys []string
+	svc := ServiceFunc(func(key string, fn func() (interface{}, error)) (interface{}, error) {
+		keys = append(keys, key)
+		return fn()
+	})
+	c := New(svc, Methods("POST"), KeyWithBody, KeyWithHeadersIncluded("X-Tenant"))
+
+	makeReq := func() *http.Request {
+		req, err := http.NewRequest("POST", "http://example.com/blah?a=1", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant", "t1")
+		return req
+	}
+
+	req := makeReq()
+	key, err := c.Key(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body), "body restored")
+
+	_, err = c.Middleware(rmock).RoundTrip(makeReq())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(keys))
+	assert.Equal(t, keys[0], key, "same key as used by the middleware")
+	assert.Len(t, key, 64, "sha256 hex")
+}
+
+func TestTiered(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString(r.URL.Path))}, nil
+	}}
+	l1, l2 := newMemCache(), newMemCache()
+	h := New(Tiered(l1, l2)).Middleware(rmock)
+
+	get := func(path string) string {
+		req, err := http.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "/blah", get("/blah"))
+	assert.Equal(t, 1, rmock.Calls())
+	assert.Equal(t, 1, l1.size(), "full miss populates l1")
+	assert.Equal(t, 1, l2.size(), "full miss populates l2")
+
+	l1.purge()
+	assert.Equal(t, "/blah", get("/blah"))
+	assert.Equal(t, 1, rmock.Calls(), "served from l2")
+	assert.Equal(t, 1, l1.size(), "l2 hit populates l1")
+
+	l2.purge()
+	assert.Equal(t, "/blah", get("/blah"))
+	assert.Equal(t, 1, rmock.Calls(), "served from l1")
+	assert.Equal(t, 0, l2.size(), "l1 hit doesn't touch l2")
+}
+
+func TestTiered_TTL(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString(r.URL.Path))}, nil
+	}}
+	clk := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l1 := &ttlCache{now: clk.Now, defaultTTL: time.Hour, data: map[string]ttlEntry{}}
+	l2 := &ttlCache{now: clk.Now, defaultTTL: time.Hour, data: map[string]ttlEntry{}}
+	svc := Tiered(l1, l2)
+	_, ok := svc.(TTLService)
+	require.True(t, ok, "tiered TTL services support TTL")
+	_, ok = Tiered(newMemCache(), l2).(TTLService)
+	assert.False(t, ok, "no TTL support without it in both tiers")
+
+	h := New(svc).Middleware(rmock)
+	get := func(ctx context.Context) {
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "/blah", string(body))
+	}
+
+	get(WithTTL(context.Background(), 10*time.Second))
+	assert.Equal(t, 1, rmock.Calls())
+	for _, c := range []*ttlCache{l1, l2} {
+		for _, e := range c.data {
+			assert.Equal(t, clk.Now().Add(10*time.Second), e.expiresAt, "individual ttl in both tiers")
+		}
+	}
+
+	clk.add(5 * time.Second)
+	get(context.Background())
+	assert.Equal(t, 1, rmock.Calls(), "served from cache")
+
+	clk.add(6 * time.Second)
+	get(context.Background())
+	assert.Equal(t, 2, rmock.Calls(), "expired in both tiers, fetched")
+}
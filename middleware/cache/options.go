@@ -1,6 +1,9 @@
 package cache
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 // Methods sets what HTTP methods allowed to be cached, default is "GET" only
 func Methods(methods ...string) func(m *Middleware) {
@@ -9,6 +12,87 @@ func Methods(methods ...string) func(m *Middleware) {
 	}
 }
 
+// CacheContentTypes limits caching to responses with the listed Content-Type only.
+// Parameters like charset are ignored. Responses with other types returned as-is but not stored.
+func CacheContentTypes(types ...string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.contentTypes = append([]string{}, types...)
+	}
+}
+
+// WithCacheStatusHeader sets the response header with cache status, HIT, MISS or STALE (served by StaleWhileRevalidate).
+// Empty name defaults to X-Cache.
+func WithCacheStatusHeader(name string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.statusHeader = name
+		if name == "" {
+			m.statusHeader = "X-Cache"
+		}
+	}
+}
+
+// AllowSetCookieCaching allows caching of responses with Set-Cookie header, refused by default.
+// Should be used in trusted scenarios only, as the cached cookie served to all callers.
+func AllowSetCookieCaching(m *Middleware) {
+	m.allowSetCookie = true
+}
+
+// CacheIf sets a predicate approving responses for storing, i.e. with non-empty body or a specific header.
+// Responses failing it returned as-is but not stored, so fetched again next time. The body can be read
+// by the predicate, it is restored for the caller.
+func CacheIf(fn func(resp *http.Response) bool) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.cacheIf = fn
+	}
+}
+
+// LegacyDumpSerializer stores responses in HTTP wire format made by httputil.DumpResponse, as it was before
+// the binary format became the default. Both formats can be read regardless of this option.
+func LegacyDumpSerializer(m *Middleware) {
+	m.legacyDump = true
+}
+
+// WithClock sets the source of current time used for the stale window, time.Now by default. Handy for tests.
+func WithClock(now func() time.Time) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.now = now
+	}
+}
+
+// CompressEntries makes responses stored gzip compressed, to save memory of the cache service on large bodies.
+// Works with both binary and legacy dump formats, compressed responses can be read regardless of this option.
+func CompressEntries(m *Middleware) {
+	m.compress = true
+}
+
+// FallbackOnError makes requests directly if the cache service fails, instead of returning the error.
+// Errors of the request itself returned as-is.
+func FallbackOnError(m *Middleware) {
+	m.fallbackOnErr = true
+}
+
+// HeadFromGet makes HEAD requests served from the cached GET response for the same key, with the status and
+// headers but no body. Without the cached GET the HEAD request made as usual and its response not stored.
+func HeadFromGet(m *Middleware) {
+	m.headFromGet = true
+}
+
+// OnError sets the hook called on errors of the cache service, i.e. for logging or metrics
+func OnError(fn func(err error)) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.onError = fn
+	}
+}
+
+// TTLFromHeader sets TTL of each stored response from its header, in seconds, i.e. "X-Cache-TTL: 300".
+// Responses without the header stored with the default TTL. Requires the Service to implement TTLService,
+// ignored otherwise.
+func TTLFromHeader(name string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.ttlHeader = name
+	}
+}
+
 // KeyWithHeaders makes all headers to affect caching key
 func KeyWithHeaders(m *Middleware) {
 	m.keyComponents.headers.enabled = true
@@ -35,9 +119,65 @@ func KeyWithBody(m *Middleware) {
 	m.keyComponents.body = true
 }
 
+// KeyWithBodyForMethods makes body to be a part of the caching key for the listed methods only, i.e. "POST" and "PUT".
+// Bodies of other requests not read.
+func KeyWithBodyForMethods(methods ...string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.keyComponents.body = true
+		m.keyComponents.bodyMethods = append([]string{}, methods...)
+	}
+}
+
+// NormalizeQuery makes query parameters sorted for the caching key, so "?a=1&b=2" and "?b=2&a=1" share the entry.
+// Parameters listed in drop, i.e. "timestamp" or "nonce", excluded from the key, same as with CacheIgnoreParams.
+// The request's url is not changed.
+func NormalizeQuery(drop ...string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.keyComponents.query.normalize = true
+		m.keyComponents.query.ignore = append(m.keyComponents.query.ignore, drop...)
+	}
+}
+
+// CacheIgnoreParams excludes query parameters from the caching key, i.e. "utm_source" or cache-busting "_",
+// so they don't fragment the cache. The order of other parameters kept unless NormalizeQuery set.
+// The request's url is not changed.
+func CacheIgnoreParams(names ...string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.keyComponents.query.ignore = append(m.keyComponents.query.ignore, names...)
+	}
+}
+
+// KeyBodyLimit sets how many bytes of the body used for the caching key, default is 16k. Negative n treated as 0.
+func KeyBodyLimit(n int) func(m *Middleware) {
+	return func(m *Middleware) {
+		if n < 0 {
+			n = 0
+		}
+		m.keyComponents.bodyLimit = n
+	}
+}
+
 // KeyFunc defines custom caching key function
 func KeyFunc(fn func(r *http.Request) string) func(m *Middleware) {
 	return func(m *Middleware) {
 		m.keyFunc = fn
 	}
 }
+
+// KeyHash defines custom hashing of the caching key, default is sha256 hex
+func KeyHash(fn func(key []byte) string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.keyHash = fn
+	}
+}
+
+// StaleWhileRevalidate allows serving the last stored response for up to window after its expiration.
+// The stale response returned immediately and the entry refreshed in background, one refresh per key at a time.
+// The ttl should match the default TTL of the backing Service, entries with individual TTL (TTLFromHeader, WithTTL)
+// use their own. The window counted from the store time plus ttl, older responses are dropped and not served.
+func StaleWhileRevalidate(ttl, window time.Duration) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.stale.ttl = ttl
+		m.stale.window = window
+	}
+}
@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+)
+
+// entryVersion marks responses stored in the binary format. Responses stored with httputil.DumpResponse
+// start with "HTTP/" and can't be confused with it.
+const entryVersion byte = 1
+
+// gzipMagic starts gzip compressed data, different from both binary and dumped formats
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// encodeResponse reads the response body and serializes the response for storing, compressed if enabled.
+// The body is replaced with in-memory copy, so the response can be read by the caller.
+func (m *Middleware) encodeResponse(resp *http.Response) ([]byte, error) {
+	data, err := m.serialize(resp)
+	if err != nil || !m.compress {
+		return data, err
+	}
+	buf := bytes.Buffer{}
+	gz := gzip.NewWriter(&buf)
+	if _, err = gz.Write(data); err != nil {
+		return nil, fmt.Errorf("compress response: %w", err)
+	}
+	if err = gz.Close(); err != nil {
+		return nil, fmt.Errorf("compress response: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Middleware) serialize(resp *http.Response) ([]byte, error) {
+	if m.legacyDump {
+		return httputil.DumpResponse(resp, true)
+	}
+
+	var body []byte
+	if resp.Body != nil {
+		var err error
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("read response body: %w", err)
+		}
+		_ = resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	keys := make([]string, 0, len(resp.Header))
+	size := len(resp.Status) + len(resp.Proto) + len(body) + 64
+	for k, vv := range resp.Header {
+		keys = append(keys, k)
+		size += len(k) + 8
+		for _, v := range vv {
+			size += len(v) + 4
+		}
+	}
+	sort.Strings(keys) // stable encoding for the same response
+
+	putString := func(b []byte, s string) []byte {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		return append(b, s...)
+	}
+
+	data := make([]byte, 0, size)
+	data = append(data, entryVersion)
+	data = binary.AppendUvarint(data, uint64(resp.StatusCode))
+	data = putString(data, resp.Status)
+	data = putString(data, resp.Proto)
+	data = binary.AppendUvarint(data, uint64(resp.ProtoMajor))
+	data = binary.AppendUvarint(data, uint64(resp.ProtoMinor))
+	data = binary.AppendUvarint(data, uint64(len(keys)))
+	for _, k := range keys {
+		data = putString(data, k)
+		data = binary.AppendUvarint(data, uint64(len(resp.Header[k])))
+		for _, v := range resp.Header[k] {
+			data = putString(data, v)
+		}
+	}
+	data = binary.AppendUvarint(data, uint64(len(body)))
+	return append(data, body...), nil
+}
+
+// decodeResponse makes response for the request from the stored data, either binary or dumped, compressed or not
+func decodeResponse(data []byte, req *http.Request) (*http.Response, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decompress cached response: %w", err)
+		}
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("decompress cached response: %w", err)
+		}
+	}
+	if len(data) == 0 || data[0] != entryVersion {
+		return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	}
+
+	d := decoder{data: data[1:]}
+	resp := &http.Response{Request: req, Header: http.Header{}}
+	resp.StatusCode = int(d.uvarint())
+	resp.Status = d.string()
+	resp.Proto = d.string()
+	resp.ProtoMajor = int(d.uvarint())
+	resp.ProtoMinor = int(d.uvarint())
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		k := d.string()
+		vv := make([]string, d.count())
+		for i := range vv {
+			vv[i] = d.string()
+		}
+		resp.Header[k] = vv
+	}
+	body := d.bytes()
+	if d.err != nil {
+		return nil, fmt.Errorf("decode cached response: %w", d.err)
+	}
+	resp.ContentLength = int64(len(body))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+var errTruncated = errors.New("truncated data")
+
+// decoder reads binary encoded fields, the first error stops reading
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads the number of following items, each takes at least one byte, so larger counts are truncated data
+func (d *decoder) count() uint64 {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errTruncated
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.data)) < n {
+		d.err = errTruncated
+		return nil
+	}
+	res := d.data[:n:n]
+	d.data = d.data[n:]
+	return res
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errStale returned by the loading function to serve a stale response without storing anything
+var errStale = errors.New("stale response served")
+
+// staleCache keeps the last stored response for each key to serve it while the expired entry is refreshed.
+// The entry considered expired ttl after it stored, or as soon as the backing Service calls the loading function
+// for it, and served stale for up to window after ttl passed. Older items removed.
+type staleCache struct {
+	ttl       time.Duration
+	window    time.Duration
+	lock      sync.Mutex
+	items     map[string]*staleItem
+	lastSweep time.Time
+}
+
+type staleItem struct {
+	data       []byte
+	expiresAt  time.Time
+	refreshing bool
+}
+
+// keepStale remembers the response stored in the cache with its ttl, zero for the default one.
+// Removes items past the stale window, at most once per window.
+func (m *Middleware) keepStale(key string, data []byte, ttl time.Duration) {
+	if m.stale.window <= 0 {
+		return
+	}
+	if ttl <= 0 {
+		ttl = m.stale.ttl
+	}
+	now := m.now()
+	m.stale.lock.Lock()
+	defer m.stale.lock.Unlock()
+	if m.stale.items == nil {
+		m.stale.items = map[string]*staleItem{}
+	}
+	if now.Sub(m.stale.lastSweep) > m.stale.window {
+		for k, item := range m.stale.items {
+			if now.After(item.expiresAt.Add(m.stale.window)) {
+				delete(m.stale.items, k)
+			}
+		}
+		m.stale.lastSweep = now
+	}
+	m.stale.items[key] = &staleItem{data: data, expiresAt: now.Add(ttl)}
+}
+
+// staleData returns the last known response for the expired key if it is still within the stale window.
+// Starts a background refresh unless one is already running for the key.
+func (m *Middleware) staleData(next http.RoundTripper, req *http.Request, key string) ([]byte, bool) {
+	if m.stale.window <= 0 {
+		return nil, false
+	}
+	m.stale.lock.Lock()
+	defer m.stale.lock.Unlock()
+
+	item, ok := m.stale.items[key]
+	if !ok {
+		return nil, false
+	}
+	if m.now().After(item.expiresAt.Add(m.stale.window)) {
+		delete(m.stale.items, key)
+		return nil, false
+	}
+	if !item.refreshing {
+		item.refreshing = true
+		go m.refresh(next, req, key)
+	}
+	return item.data, true
+}
+
+// refresh fetches the response with a detached context and stores it in the cache
+func (m *Middleware) refresh(next http.RoundTripper, req *http.Request, key string) {
+	defer func() {
+		m.stale.lock.Lock()
+		if item, ok := m.stale.items[key]; ok {
+			item.refreshing = false
+		}
+		m.stale.lock.Unlock()
+	}()
+
+	// the original request's context may be canceled as soon as the stale response returned
+	rreq := req.Clone(context.Background())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return
+		}
+		rreq.Body = body
+	}
+
+	_, _ = m.load(key, func() (interface{}, time.Duration, error) {
+		resp, data, err := m.fetch(next, rreq)
+		if errors.Is(err, errNotCacheable) && resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+		ttl := m.entryTTL(req, resp) // original request keeps the context with TTL
+		if err == nil && data != nil {
+			m.keepStale(key, data.([]byte), ttl)
+		}
+		return data, ttl, err
+	})
+}
@@ -0,0 +1,47 @@
+package cache
+
+import "time"
+
+// Tiered makes Service looking up l1 (i.e. in-memory) first, then l2 (i.e. shared redis) and the backend last.
+// An l2 hit populates l1, a full miss populates both. The loaders nested, so the backend fetched once per miss.
+// If both services implement TTLService the result implements it too, entries fetched from the backend stored
+// in both tiers with the TTL set by TTLFromHeader or WithTTL. An l2 hit stored in l1 with the default TTL of l1,
+// as the remaining TTL of the l2 entry is unknown.
+func Tiered(l1, l2 Service) Service {
+	t1, ok1 := l1.(TTLService)
+	t2, ok2 := l2.(TTLService)
+	if ok1 && ok2 {
+		return tieredTTL{l1: t1, l2: t2}
+	}
+	return ServiceFunc(func(key string, fn func() (interface{}, error)) (interface{}, error) {
+		return l1.Get(key, func() (interface{}, error) {
+			return l2.Get(key, fn)
+		})
+	})
+}
+
+// tieredTTL is Tiered combination of two TTLService
+type tieredTTL struct {
+	l1, l2 TTLService
+}
+
+// Get loads the value with the default TTL
+func (t tieredTTL) Get(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return t.GetWithTTL(key, func() (interface{}, time.Duration, error) {
+		v, err := fn()
+		return v, 0, err
+	})
+}
+
+// GetWithTTL loads the value, stored with TTL returned by fn in both tiers
+func (t tieredTTL) GetWithTTL(key string, fn func() (interface{}, time.Duration, error)) (interface{}, error) {
+	return t.l1.GetWithTTL(key, func() (interface{}, time.Duration, error) {
+		var ttl time.Duration // stays zero on l2 hit
+		v, err := t.l2.GetWithTTL(key, func() (interface{}, time.Duration, error) {
+			v, fttl, err := fn()
+			ttl = fttl
+			return v, fttl, err
+		})
+		return v, ttl, err
+	})
+}
@@ -1,12 +1,41 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 )
 
-// CircuitBreaker middleware injects external CircuitBreakerSvc into the call chain
-func CircuitBreaker(svc CircuitBreakerSvc) RoundTripperHandler {
+// CircuitBreakerOption defines optional parameters of CircuitBreaker
+type CircuitBreakerOption func(o *circuitBreakerOptions)
+
+type circuitBreakerOptions struct {
+	failOnCodes []int
+}
+
+// CircuitBreakerFailOnCodes sets status codes counted by the breaker as failures, i.e. 500 and 503.
+// Such responses reported to CircuitBreakerSvc as errors, but still returned to the caller as responses
+// while the breaker is closed. Once the breaker opened, requests fail with the breaker's error.
+func CircuitBreakerFailOnCodes(codes ...int) CircuitBreakerOption {
+	return func(o *circuitBreakerOptions) {
+		o.failOnCodes = append(o.failOnCodes, codes...)
+	}
+}
+
+// statusFailure passes the failed response through CircuitBreakerSvc.Execute as an error
+type statusFailure struct {
+	resp *http.Response
+}
+
+func (e *statusFailure) Error() string { return "failed status " + e.resp.Status }
+
+// CircuitBreaker middleware injects external CircuitBreakerSvc into the call chain.
+// By default only transport errors reported to the breaker as failures.
+func CircuitBreaker(svc CircuitBreakerSvc, opts ...CircuitBreakerOption) RoundTripperHandler {
+	o := circuitBreakerOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		fn := func(req *http.Request) (*http.Response, error) {
@@ -16,8 +45,19 @@ func CircuitBreaker(svc CircuitBreakerSvc) RoundTripperHandler {
 			}
 
 			resp, e := svc.Execute(func() (interface{}, error) {
-				return next.RoundTrip(req)
+				resp, err := next.RoundTrip(req)
+				if err != nil {
+					return resp, err
+				}
+				if o.failed(resp.StatusCode) {
+					return resp, &statusFailure{resp: resp}
+				}
+				return resp, nil
 			})
+			var sf *statusFailure
+			if errors.As(e, &sf) {
+				return sf.resp, nil // counted as failure by the breaker, but the response returned as is
+			}
 			if e != nil {
 				return nil, fmt.Errorf("circuit breaker: %w", e)
 			}
@@ -27,6 +67,15 @@ func CircuitBreaker(svc CircuitBreakerSvc) RoundTripperHandler {
 	}
 }
 
+func (o circuitBreakerOptions) failed(code int) bool {
+	for _, c := range o.failOnCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
 // CircuitBreakerSvc is an interface wrapping any function to send a request with circuit breaker.
 // can be used with github.com/sony/gobreaker or any similar implementations
 type CircuitBreakerSvc interface {
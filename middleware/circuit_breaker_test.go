@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"testing"
 
@@ -37,3 +38,65 @@ func TestCircuitBreaker(t *testing.T) {
 	assert.Equal(t, 1, rmock.Calls())
 	assert.Equal(t, 1, len(cbMock.ExecuteCalls()))
 }
+
+func TestCircuitBreaker_FailOnCodes(t *testing.T) {
+	errOpen := errors.New("circuit breaker is open")
+	failures := 0
+	cbMock := &mocks.CircuitBreakerSvcMock{
+		ExecuteFunc: func(req func() (interface{}, error)) (interface{}, error) {
+			if failures >= 3 {
+				return nil, errOpen
+			}
+			resp, err := req()
+			if err != nil {
+				failures++
+			}
+			return resp, err
+		},
+	}
+
+	rmock := &mocks.RoundTripper{
+		RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 500, Status: "500 Internal Server Error"}, nil
+		},
+	}
+
+	h := CircuitBreaker(cbMock, CircuitBreakerFailOnCodes(500, 503))(rmock)
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err, "response returned while the breaker closed")
+		assert.Equal(t, 500, resp.StatusCode)
+	}
+	assert.Equal(t, 3, failures)
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errOpen))
+	assert.Equal(t, 3, rmock.Calls(), "short-circuited, no request made")
+	assert.Equal(t, 4, len(cbMock.ExecuteCalls()))
+}
+
+func TestCircuitBreaker_StatusNotFailureByDefault(t *testing.T) {
+	cbMock := &mocks.CircuitBreakerSvcMock{
+		ExecuteFunc: func(req func() (interface{}, error)) (interface{}, error) {
+			resp, err := req()
+			assert.NoError(t, err)
+			return resp, err
+		},
+	}
+	rmock := &mocks.RoundTripper{
+		RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 500}, nil
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := CircuitBreaker(cbMock)(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+}
@@ -1,20 +1,106 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
-// MaxConcurrent middleware limits the total concurrency for a given requester
+// ErrShuttingDown returned by Limiter for requests made after Shutdown call
+var ErrShuttingDown = errors.New("limiter is shutting down")
+
+// Limiter limits the total concurrency of requests passed through its Middleware.
+// Supports graceful shutdown, rejecting new requests and waiting for in-flight ones.
+type Limiter struct {
+	sema chan struct{}
+	obs  func(waited time.Duration)
+
+	lock     sync.RWMutex
+	closing  bool
+	inFlight sync.WaitGroup
+}
+
+// NewLimiter makes Limiter allowing up to maxLimit concurrent requests
+func NewLimiter(maxLimit int) *Limiter {
+	return &Limiter{sema: make(chan struct{}, maxLimit)}
+}
+
+// MaxConcurrent middleware limits the total concurrency for a given requester.
+// The request waiting for a slot fails if its context canceled.
 func MaxConcurrent(maxLimit int) func(http.RoundTripper) http.RoundTripper {
-	sema := make(chan struct{}, maxLimit)
-	return func(next http.RoundTripper) http.RoundTripper {
-		fn := func(req *http.Request) (*http.Response, error) {
-			sema <- struct{}{}
-			defer func() {
-				<-sema
-			}()
-			return next.RoundTrip(req)
+	return NewLimiter(maxLimit).Middleware
+}
+
+// MaxConcurrentShared middleware limits concurrency with the semaphore owned by the caller, the capacity of sem is the limit.
+// The same sem can be passed to several requesters, so all of them honor a single global cap.
+// Panics if sem is nil or unbuffered, as no request could ever get a slot.
+func MaxConcurrentShared(sem chan struct{}) RoundTripperHandler {
+	if cap(sem) == 0 {
+		panic("max concurrent shared: semaphore channel must be buffered, i.e. make(chan struct{}, limit)")
+	}
+	return (&Limiter{sema: sem}).Middleware
+}
+
+// MaxConcurrentWithObserver is the same as MaxConcurrent, but reports the time spent waiting for a slot to obs.
+// The observer called for canceled requests too, with the time waited till cancellation.
+func MaxConcurrentWithObserver(maxLimit int, obs func(waited time.Duration)) RoundTripperHandler {
+	l := NewLimiter(maxLimit)
+	l.obs = obs
+	return l.Middleware
+}
+
+// Middleware limits concurrency of requests, waiting for a free slot
+func (l *Limiter) Middleware(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		l.lock.RLock()
+		if l.closing {
+			l.lock.RUnlock()
+			return nil, ErrShuttingDown
+		}
+		l.inFlight.Add(1)
+		l.lock.RUnlock()
+		defer l.inFlight.Done()
+
+		st := time.Now()
+		select {
+		case l.sema <- struct{}{}:
+		case <-req.Context().Done():
+			if l.obs != nil {
+				l.obs(time.Since(st))
+			}
+			return nil, fmt.Errorf("max concurrent: %w", req.Context().Err())
+		}
+		if l.obs != nil {
+			l.obs(time.Since(st))
 		}
-		return RoundTripperFunc(fn)
+		defer func() {
+			<-l.sema
+		}()
+		return next.RoundTrip(req)
+	}
+	return RoundTripperFunc(fn)
+}
+
+// Shutdown stops accepting new requests, failing them with ErrShuttingDown, and waits for in-flight
+// (including queued) requests to complete. Returns context's error if it is done before.
+func (l *Limiter) Shutdown(ctx context.Context) error {
+	l.lock.Lock()
+	l.closing = true
+	l.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
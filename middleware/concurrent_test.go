@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"net/http"
 	"sync"
@@ -48,3 +50,166 @@ func TestMaxConcurrentHandler(t *testing.T) {
 
 	assert.Equal(t, 100, rmock.Calls())
 }
+
+func TestMaxConcurrentWithObserver(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		time.Sleep(100 * time.Millisecond)
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	var lock sync.Mutex
+	var waits []time.Duration
+	h := MaxConcurrentWithObserver(1, func(waited time.Duration) {
+		lock.Lock()
+		waits = append(waits, waited)
+		lock.Unlock()
+	})(rmock)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			resp, err := h.RoundTrip(req)
+			require.NoError(t, err)
+			assert.Equal(t, 201, resp.StatusCode)
+		}()
+		time.Sleep(10 * time.Millisecond) // make sure the first one took the slot
+	}
+
+	// queued request canceled while waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 3, len(waits))
+	assert.Less(t, int64(waits[0]), int64(10*time.Millisecond), "first request not queued")
+	assert.GreaterOrEqual(t, int64(waits[1]), int64(20*time.Millisecond), "canceled request waited till cancellation")
+	assert.Less(t, int64(waits[1]), int64(80*time.Millisecond), "canceled request waited till cancellation")
+	assert.GreaterOrEqual(t, int64(waits[2]), int64(50*time.Millisecond), "second request queued")
+	assert.Equal(t, 2, rmock.Calls())
+}
+
+func TestLimiter_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		<-release
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	l := NewLimiter(2)
+	h := l.Middleware(rmock)
+
+	var completed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ { // two in-flight, one queued
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			resp, err := h.RoundTrip(req)
+			require.NoError(t, err)
+			assert.Equal(t, 201, resp.StatusCode)
+			atomic.AddInt32(&completed, 1)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- l.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	assert.Equal(t, ErrShuttingDown, err, "new request rejected")
+
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown returned before in-flight requests completed")
+	default:
+	}
+
+	close(release)
+	require.NoError(t, <-shutdownErr)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&completed))
+	wg.Wait()
+	assert.Equal(t, 3, rmock.Calls())
+}
+
+func TestLimiter_ShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		<-release
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	l := NewLimiter(1)
+	go func() {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, _ = l.Middleware(rmock).RoundTrip(req)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.Shutdown(ctx))
+}
+
+func TestMaxConcurrentShared(t *testing.T) {
+	var inFlight, maxInFlight int32
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		c := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if c <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, c) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * time.Duration(rand.Intn(10))) // nolint
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	sem := make(chan struct{}, 4)
+	h1 := MaxConcurrentShared(sem)(rmock)
+	h2 := Header("k1", "v1")(MaxConcurrentShared(sem)(rmock))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		h := h1
+		if i%2 == 0 {
+			h = h2
+		}
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			_, err = h.RoundTrip(req)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, rmock.Calls())
+	assert.True(t, atomic.LoadInt32(&maxInFlight) <= 4, maxInFlight)
+	assert.Equal(t, 0, len(sem), "all slots released")
+}
+
+func TestMaxConcurrentShared_Unbuffered(t *testing.T) {
+	assert.PanicsWithValue(t, "max concurrent shared: semaphore channel must be buffered, i.e. make(chan struct{}, limit)",
+		func() { MaxConcurrentShared(nil) })
+	assert.Panics(t, func() { MaxConcurrentShared(make(chan struct{})) })
+	assert.NotPanics(t, func() { MaxConcurrentShared(make(chan struct{}, 1)) })
+}
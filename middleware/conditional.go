@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// ConditionalStore keeps validators, ETag and Last-Modified, of the responses per url
+type ConditionalStore interface {
+	GetValidators(url string) (etag, lastModified string)
+	SetValidators(url, etag, lastModified string)
+}
+
+// ConditionalGet middleware remembers ETag and Last-Modified of GET responses in the store and sends them
+// with If-None-Match and If-Modified-Since headers on subsequent GETs of the same url. 304 Not Modified responses
+// passed to the caller as-is, it is up to the caller to keep the body. Validators set by the caller not overridden.
+func ConditionalGet(store ConditionalStore) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if store == nil || req.Method != http.MethodGet {
+				return next.RoundTrip(req)
+			}
+
+			key := req.URL.String()
+			if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+				etag, lastModified := store.GetValidators(key)
+				if etag != "" {
+					req.Header.Set("If-None-Match", etag)
+				}
+				if lastModified != "" {
+					req.Header.Set("If-Modified-Since", lastModified)
+				}
+			}
+
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				return resp, err
+			}
+			etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+			if etag != "" || lastModified != "" {
+				store.SetValidators(key, etag, lastModified)
+			}
+			return resp, nil
+		}
+		return RoundTripperFunc(fn)
+	}
+}
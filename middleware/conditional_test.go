@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalGet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	var sent []http.Header
+	rt := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		sent = append(sent, r.Header.Clone())
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	store := &memValidators{data: map[string][2]string{}}
+	h := ConditionalGet(store)(rt)
+
+	req, err := http.NewRequest("GET", ts.URL+"/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, [2]string{`"v1"`, "Wed, 21 Oct 2015 07:28:00 GMT"}, store.data[ts.URL+"/blah"])
+
+	req, err = http.NewRequest("GET", ts.URL+"/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, "304 passed to the caller")
+
+	req, err = http.NewRequest("GET", ts.URL+"/other", http.NoBody)
+	require.NoError(t, err)
+	resp, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	req, err = http.NewRequest("POST", ts.URL+"/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, 4, len(sent))
+	assert.Equal(t, "", sent[0].Get("If-None-Match"))
+	assert.Equal(t, `"v1"`, sent[1].Get("If-None-Match"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", sent[1].Get("If-Modified-Since"))
+	assert.Equal(t, "", sent[2].Get("If-None-Match"), "different url")
+	assert.Equal(t, "", sent[3].Get("If-None-Match"), "not GET")
+}
+
+type memValidators struct {
+	sync.Mutex
+	data map[string][2]string
+}
+
+func (s *memValidators) GetValidators(url string) (etag, lastModified string) {
+	s.Lock()
+	defer s.Unlock()
+	v := s.data[url]
+	return v[0], v[1]
+}
+
+func (s *memValidators) SetValidators(url, etag, lastModified string) {
+	s.Lock()
+	defer s.Unlock()
+	s.data[url] = [2]string{etag, lastModified}
+}
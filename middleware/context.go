@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// ContextKey is a type of the context keys populated by built-in middlewares
+type ContextKey string
+
+const (
+	// CtxAttempt key holds int number of the current attempt, starting from 1. Set by Repeater.
+	CtxAttempt ContextKey = "attempt"
+	// CtxAttemptsRemaining key holds int number of attempts left after the current one. Set by Repeater
+	// with RepeaterMaxAttempts option.
+	CtxAttemptsRemaining ContextKey = "attempts-remaining"
+	// CtxFallbackHost key holds string host the request sent to. Set by Fallback.
+	CtxFallbackHost ContextKey = "fallback-host"
+	// CtxAttemptObserver key holds AttemptObserver called by Repeater after each attempt. Set by the caller.
+	CtxAttemptObserver ContextKey = "attempt-observer"
+	// CtxProxy key holds *url.URL of the proxy for the request. Set by ProxyRotate and ProxyRandom.
+	CtxProxy ContextKey = "proxy"
+)
+
+// AttemptObserver gets the number and the result of each attempt made by Repeater
+type AttemptObserver func(attempt int, resp *http.Response, err error)
+
+// WithValue middleware stores the value in the request context, so the downstream middlewares can use it
+func WithValue(key, val interface{}) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			return next.RoundTrip(req.WithContext(context.WithValue(req.Context(), key, val)))
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// AttemptFromContext returns the current attempt number set by Repeater, 0 if not set
+func AttemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(CtxAttempt).(int)
+	return attempt
+}
+
+// AttemptsRemaining returns the number of attempts left after the current one, set by Repeater with
+// RepeaterMaxAttempts option. I.e. a rate limiter can back off more on the last attempt. False if not set.
+func AttemptsRemaining(ctx context.Context) (int, bool) {
+	remaining, ok := ctx.Value(CtxAttemptsRemaining).(int)
+	return remaining, ok
+}
+
+// BaseContext middleware cancels requests when the base context done, i.e. on shutdown of the service owning
+// the requester, in addition to the request's own context. The request's context values kept.
+// The combined context released when the response body closed.
+func BaseContext(base context.Context) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if base.Done() == nil { // never canceled
+				return next.RoundTrip(req)
+			}
+			ctx, cancel := context.WithCancel(req.Context())
+			go func() {
+				select {
+				case <-base.Done():
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			resp, err := next.RoundTrip(req.WithContext(ctx))
+			if err != nil || resp.Body == nil {
+				cancel()
+				return resp, err
+			}
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		return RoundTripperFunc(fn)
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestWithValue(t *testing.T) {
+	type key struct{}
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "val", r.Context().Value(key{}))
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := WithValue(key{}, "val")(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Nil(t, req.Context().Value(key{}), "original request not modified")
+}
+
+func TestContext_RepeaterAttempt(t *testing.T) {
+	var attempts []int
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if len(attempts) < 3 {
+			return &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	// custom middleware placed after Repeater
+	observer := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			attempts = append(attempts, AttemptFromContext(r.Context()))
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := Repeater(repeater)(observer(rmock)).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+	assert.Equal(t, 0, AttemptFromContext(req.Context()))
+}
+
+func TestContext_FallbackHost(t *testing.T) {
+	var hosts []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.Context().Value(CtxFallbackHost).(string))
+		if r.URL.Host != "alt2.example.com" {
+			return &http.Response{StatusCode: 503}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := Fallback("alt1.example.com", "alt2.example.com")(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"example.com", "alt1.example.com", "alt2.example.com"}, hosts)
+}
+
+func TestBaseContext(t *testing.T) {
+	type key struct{}
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "val", r.Context().Value(key{}), "request's context values kept")
+		if r.URL.Path == "/fast" {
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+		}
+		select {
+		case <-time.After(time.Second):
+			return &http.Response{StatusCode: 200}, nil
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}}
+	base, cancel := context.WithCancel(context.Background())
+	h := BaseContext(base)(rmock)
+	ctx := context.WithValue(context.Background(), key{}, "val")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/fast", http.NoBody)
+	require.NoError(t, err)
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	require.NoError(t, resp.Body.Close())
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, err = http.NewRequestWithContext(ctx, "GET", "http://example.com/slow", http.NoBody)
+	require.NoError(t, err)
+	st := time.Now()
+	_, err = h.RoundTrip(req)
+	require.ErrorIs(t, err, context.Canceled, "in-flight request aborted by base context")
+	assert.True(t, time.Since(st) < 500*time.Millisecond)
+	assert.NoError(t, ctx.Err(), "request's own context still live")
+
+	_, err = BaseContext(context.Background())(rmock).RoundTrip(req.WithContext(ctx))
+	require.NoError(t, err, "never canceled base context")
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ForwardDeadline middleware sets header to the time remaining until the request context deadline, in milliseconds,
+// so downstream services can honor the caller's budget. An expired deadline set as 0.
+// The header is not set if the context has no deadline.
+func ForwardDeadline(header string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			deadline, ok := req.Context().Deadline()
+			if !ok {
+				return next.RoundTrip(req)
+			}
+			remaining := time.Until(deadline).Milliseconds()
+			if remaining < 0 {
+				remaining = 0
+			}
+			req.Header.Set(header, strconv.FormatInt(remaining, 10))
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestForwardDeadline(t *testing.T) {
+	var headers []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		headers = append(headers, r.Header.Get("X-Request-Timeout"))
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	h := ForwardDeadline("X-Request-Timeout")(rmock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	_, ok := req.Header["X-Request-Timeout"]
+	assert.False(t, ok, "header not set without deadline")
+
+	expiredCtx, expiredCancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer expiredCancel()
+	req, err = http.NewRequestWithContext(expiredCtx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, 3, len(headers))
+	remaining, err := strconv.Atoi(headers[0])
+	require.NoError(t, err)
+	assert.True(t, remaining > 4900 && remaining <= 5000, remaining)
+	assert.Equal(t, "", headers[1])
+	assert.Equal(t, "0", headers[2])
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Fallback middleware repeats the request on alternate hosts if it failed with a transport error or 5xx status.
+// Hosts tried in the given order till the first success, the result of the last attempt returned if all failed.
+// The request body replayed with GetBody, requests with a body and without GetBody are not repeated.
+// The host of the current attempt stored in the request context with CtxFallbackHost key.
+func Fallback(hosts ...string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req.WithContext(context.WithValue(req.Context(), CtxFallbackHost, req.URL.Host)))
+			for _, host := range hosts {
+				if err == nil && resp.StatusCode < 500 {
+					return resp, nil
+				}
+				if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+					break // body can't be replayed
+				}
+
+				if resp != nil && resp.Body != nil {
+					_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+					_ = resp.Body.Close() // failed response discarded, drained to reuse the connection
+				}
+				r := req.Clone(context.WithValue(req.Context(), CtxFallbackHost, host))
+				r.URL.Host, r.Host = host, host
+				if req.GetBody != nil {
+					body, e := req.GetBody()
+					if e != nil {
+						return nil, fmt.Errorf("fallback get body: %w", e)
+					}
+					r.Body = body
+				}
+				resp, err = next.RoundTrip(r)
+			}
+			return resp, err
+		}
+		return RoundTripperFunc(fn)
+	}
+}
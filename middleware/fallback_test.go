@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestFallback(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("healthy " + r.Host + " " + string(body)))
+		require.NoError(t, err)
+	}))
+	defer healthy.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	host := func(ts *httptest.Server) string {
+		u, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+		return u.Host
+	}
+
+	t.Run("failing primary", func(t *testing.T) {
+		req, err := http.NewRequest("POST", failing.URL+"/path", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		resp, err := Fallback(host(down), host(healthy))(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "healthy "+host(healthy)+" body", string(body))
+	})
+
+	t.Run("healthy primary", func(t *testing.T) {
+		req, err := http.NewRequest("GET", healthy.URL, http.NoBody)
+		require.NoError(t, err)
+		resp, err := Fallback(host(failing))(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		req, err := http.NewRequest("GET", failing.URL, http.NoBody)
+		require.NoError(t, err)
+		_, err = Fallback(host(failing), host(down))(http.DefaultTransport).RoundTrip(req)
+		require.Error(t, err)
+
+		req, err = http.NewRequest("GET", down.URL, http.NoBody)
+		require.NoError(t, err)
+		resp, err := Fallback(host(down), host(failing))(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "last response returned")
+	})
+}
+
+func TestFallback_GetBodyFailed(t *testing.T) {
+	var closed, drained bool
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		body := &closeSpy{Reader: strings.NewReader("bad gateway"), onClose: func(rest int) {
+			closed, drained = true, rest == 0
+		}}
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: body}, nil
+	}}
+
+	req, err := http.NewRequest("POST", "http://primary.example.com/path", bytes.NewBufferString("body"))
+	require.NoError(t, err)
+	req.GetBody = func() (io.ReadCloser, error) { return nil, errors.New("get body failed") }
+	_, err = Fallback("secondary.example.com")(rmock).RoundTrip(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "get body failed")
+	assert.Equal(t, 1, rmock.Calls())
+	assert.True(t, closed, "failed response closed")
+	assert.True(t, drained, "failed response drained")
+}
+
+func TestFallback_DrainLimited(t *testing.T) {
+	rest := -1
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "secondary.example.com" {
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		}
+		body := &closeSpy{Reader: strings.NewReader(strings.Repeat("x", 1024*1024)), onClose: func(n int) { rest = n }}
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: body}, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://primary.example.com/path", http.NoBody)
+	require.NoError(t, err)
+	resp, err := Fallback("secondary.example.com")(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 1024*1024-4096, rest, "huge failed body drained up to the limit only")
+}
+
+// closeSpy reports the number of unread bytes on Close
+type closeSpy struct {
+	*strings.Reader
+	onClose func(rest int)
+}
+
+func (c *closeSpy) Close() error {
+	c.onClose(c.Len())
+	return nil
+}
@@ -1,7 +1,10 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
+	"sort"
+	"strings"
 )
 
 // Header middleware adds a header to request
@@ -15,6 +18,36 @@ func Header(key, value string) func(http.RoundTripper) http.RoundTripper {
 	}
 }
 
+type headersKey struct{}
+
+// WithHeaders returns derived context with headers applied by HeadersFromContext middleware to requests made with it.
+// Headers merged with ones set by the parent context, the latter overridden for the same keys.
+func WithHeaders(ctx context.Context, h http.Header) context.Context {
+	res := http.Header{}
+	if parent, ok := ctx.Value(headersKey{}).(http.Header); ok {
+		for k, vv := range parent {
+			res[k] = vv
+		}
+	}
+	for k, vv := range h.Clone() {
+		res[http.CanonicalHeaderKey(k)] = vv
+	}
+	return context.WithValue(ctx, headersKey{}, res)
+}
+
+// HeadersFromContext middleware sets headers stored in the request context by WithHeaders
+func HeadersFromContext(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		if h, ok := req.Context().Value(headersKey{}).(http.Header); ok {
+			for k, vv := range h {
+				req.Header[k] = append([]string{}, vv...)
+			}
+		}
+		return next.RoundTrip(req)
+	}
+	return RoundTripperFunc(fn)
+}
+
 // JSON sets Content-Type and Accept headers to json
 func JSON(next http.RoundTripper) http.RoundTripper {
 	fn := func(req *http.Request) (*http.Response, error) {
@@ -35,3 +68,141 @@ func BasicAuth(user, passwd string) func(http.RoundTripper) http.RoundTripper {
 		return RoundTripperFunc(fn)
 	}
 }
+
+// StripHeaders middleware removes given headers from request, i.e. internal headers not to be leaked when forwarding
+func StripHeaders(names ...string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			for _, name := range names {
+				req.Header.Del(name)
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// hopByHopHeaders removed by StripHopByHop, in addition to Proxy-* and ones listed in Connection header
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// StripHopByHop middleware removes hop-by-hop headers, Connection, Keep-Alive, Proxy-*, Te, Trailer,
+// Transfer-Encoding and Upgrade, as well as headers listed in Connection header
+func StripHopByHop(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		for _, v := range req.Header.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					req.Header.Del(name)
+				}
+			}
+		}
+		for _, name := range hopByHopHeaders {
+			req.Header.Del(name)
+		}
+		for name := range req.Header {
+			if strings.HasPrefix(name, "Proxy-") {
+				req.Header.Del(name)
+			}
+		}
+		return next.RoundTrip(req)
+	}
+	return RoundTripperFunc(fn)
+}
+
+// EnableAutoDecompress middleware removes Accept-Encoding header set by the user, so the standard http.Transport
+// requests gzip itself and transparently decompresses the response. With Accept-Encoding set by the user
+// the transport returns the body as-is, compressed. Encodings other than gzip (i.e. br) are not requested anymore.
+// Has no effect if the transport has DisableCompression set.
+func EnableAutoDecompress(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		req.Header.Del("Accept-Encoding")
+		return next.RoundTrip(req)
+	}
+	return RoundTripperFunc(fn)
+}
+
+// MissingHeadersError returned by RequireHeaders middleware for requests without required headers
+type MissingHeadersError struct {
+	Headers []string // names of missing headers, as passed to RequireHeaders
+}
+
+func (e *MissingHeadersError) Error() string {
+	return "missing required headers: " + strings.Join(e.Headers, ", ")
+}
+
+// RequireHeaders middleware fails requests without non-empty values of all listed headers, i.e. tenant id,
+// with *MissingHeadersError. The request is not sent, so misconfigured calls fail before reaching the server.
+func RequireHeaders(names ...string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			var missing []string
+			for _, name := range names {
+				if req.Header.Get(name) == "" {
+					missing = append(missing, name)
+				}
+			}
+			if len(missing) > 0 {
+				return nil, &MissingHeadersError{Headers: missing}
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// CanonicalizeHeaders middleware makes header keys canonical MIME cased, i.e. "x-api-key" to "X-Api-Key",
+// merging values of keys differing by case only, values of the canonical key first, then of others sorted by key.
+// For headers listed in join duplicated values removed and the rest joined with commas into a single value,
+// i.e. for upstreams rejecting repeated headers. Other multi-valued headers, like Accept, kept as-is.
+func CanonicalizeHeaders(join ...string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			var keys []string
+			for k := range req.Header {
+				if http.CanonicalHeaderKey(k) != k {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys) // merged in stable order, after values of the canonical key
+			for _, k := range keys {
+				ck := http.CanonicalHeaderKey(k)
+				req.Header[ck] = append(req.Header[ck], req.Header[k]...)
+				delete(req.Header, k)
+			}
+			for _, name := range join {
+				vv := req.Header.Values(name)
+				if len(vv) < 2 {
+					continue
+				}
+				uniq := make([]string, 0, len(vv))
+				seen := map[string]bool{}
+				for _, v := range vv {
+					if !seen[v] {
+						seen[v] = true
+						uniq = append(uniq, v)
+					}
+				}
+				req.Header.Set(name, strings.Join(uniq, ", "))
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// SetHost middleware sets the Host of requests, i.e. to reach the virtual host behind a gateway while the connection
+// made to the url's address. Sets req.Host, as the transport ignores Host in headers. The caller's request not modified.
+func SetHost(host string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			r := req.WithContext(req.Context())
+			r.Host = host
+			if _, ok := req.Header["Host"]; ok {
+				r.Header = req.Header.Clone()
+				r.Header.Del("Host")
+			}
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
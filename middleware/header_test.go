@@ -1,7 +1,13 @@
 package middleware
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -60,3 +66,203 @@ func TestBasicAuth(t *testing.T) {
 	assert.Equal(t, 201, resp.StatusCode)
 	assert.Equal(t, 1, rmock.Calls())
 }
+
+func TestStripHeaders(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "", r.Header.Get("X-Internal"))
+		assert.Equal(t, "", r.Header.Get("X-Secret"))
+		assert.Equal(t, "v1", r.Header.Get("k1"))
+		resp := &http.Response{StatusCode: 201}
+		return resp, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Internal", "blah")
+	req.Header.Set("X-Secret", "123")
+	req.Header.Set("k1", "v1")
+
+	resp, err := StripHeaders("x-internal", "X-Secret", "not-set")(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestStripHopByHop(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection",
+			"Te", "Trailer", "Transfer-Encoding", "Upgrade", "X-Conn-Private"} {
+			assert.Equal(t, "", r.Header.Get(h), h)
+		}
+		assert.Equal(t, "v1", r.Header.Get("k1"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		resp := &http.Response{StatusCode: 201}
+		return resp, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "keep-alive, X-Conn-Private")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic xyz")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Trailer", "Expires")
+	req.Header.Set("Transfer-Encoding", "chunked")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-Conn-Private", "blah")
+	req.Header.Set("k1", "v1")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := StripHopByHop(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestHeadersFromContext(t *testing.T) {
+	var headers []http.Header
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		headers = append(headers, r.Header.Clone())
+		return &http.Response{StatusCode: 201}, nil
+	}}
+	h := HeadersFromContext(rmock)
+
+	ctx := WithHeaders(context.Background(), http.Header{"k1": {"v1"}, "K2": {"v2"}})
+	ctx = WithHeaders(ctx, http.Header{"K2": {"v22", "v23"}, "K3": {"v3"}})
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("k0", "v0")
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(headers))
+	assert.Equal(t, http.Header{"K0": {"v0"}, "K1": {"v1"}, "K2": {"v22", "v23"}, "K3": {"v3"}}, headers[0])
+	assert.Equal(t, http.Header{}, headers[1], "no headers leaked to request without them")
+}
+
+func TestEnableAutoDecompress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = w.Write([]byte("plain response"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte("gzipped response"))
+		_ = gz.Close()
+	}))
+	defer ts.Close()
+
+	get := func(tr http.RoundTripper) string {
+		req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.NotEqual(t, "gzipped response", get(http.DefaultTransport), "raw gzip without the middleware")
+	assert.Equal(t, "gzipped response", get(EnableAutoDecompress(http.DefaultTransport)))
+
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "", r.Header.Get("Accept-Encoding"))
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	_, err = EnableAutoDecompress(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestRequireHeaders(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 201}, nil
+	}}
+	h := RequireHeaders("X-Tenant-Id", "X-Trace-Id")(rmock)
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Tenant-Id", "t1")
+	req.Header.Set("X-Trace-Id", "123")
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	req.Header.Set("X-Trace-Id", "")
+	_, err = h.RoundTrip(req)
+	require.EqualError(t, err, "missing required headers: X-Trace-Id")
+	var mhe *MissingHeadersError
+	require.True(t, errors.As(err, &mhe))
+	assert.Equal(t, []string{"X-Trace-Id"}, mhe.Headers)
+
+	req.Header.Del("X-Tenant-Id")
+	_, err = h.RoundTrip(req)
+	require.EqualError(t, err, "missing required headers: X-Tenant-Id, X-Trace-Id")
+	assert.Equal(t, 1, rmock.Calls(), "requests with missing headers not sent")
+}
+
+func TestCanonicalizeHeaders(t *testing.T) {
+	var hdr http.Header
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		hdr = r.Header.Clone()
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header = http.Header{
+		"x-api-key":     {"k1"},
+		"CACHE-CONTROL": {"no-cache"},
+		"Cache-Control": {"no-store", "no-cache"},
+		"Accept":        {"text/html", "application/json", "text/html"},
+		"X-Tags":        {"a", "b", "a"},
+		"X-Single":      {"v"},
+		"x-id":          {"3"},
+		"X-ID":          {"2"},
+		"X-Id":          {"1"},
+	}
+	_, err = CanonicalizeHeaders("cache-control", "X-Single")(rmock).RoundTrip(req)
+	require.NoError(t, err)
+
+	require.Equal(t, 6, len(hdr))
+	assert.Equal(t, []string{"k1"}, hdr["X-Api-Key"], "casing normalized")
+	assert.Equal(t, 1, len(hdr["Cache-Control"]), "joined into single value")
+	assert.Equal(t, "no-store, no-cache", hdr.Get("Cache-Control"), "duplicates removed for configured header")
+	assert.Equal(t, []string{"1", "2", "3"}, hdr["X-Id"], "canonical key first, then others sorted by key")
+	assert.Equal(t, []string{"text/html", "application/json", "text/html"}, hdr["Accept"], "not configured, kept as-is")
+	assert.Equal(t, []string{"a", "b", "a"}, hdr["X-Tags"])
+	assert.Equal(t, []string{"v"}, hdr["X-Single"])
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestSetHost(t *testing.T) {
+	var hosts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Host", "ignored.example.com")
+	resp, err := SetHost("api.example.com")(http.DefaultTransport).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "connected to the url's address")
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, []string{"api.example.com"}, hosts)
+	assert.Equal(t, strings.TrimPrefix(ts.URL, "http://"), req.Host, "caller's request not modified")
+	assert.Equal(t, "ignored.example.com", req.Header.Get("Host"))
+}
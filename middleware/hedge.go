@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Hedge middleware sends up to maxExtra additional copies of the request, one each delay, if no response received yet.
+// The first successful response returned and the other attempts canceled, their responses discarded.
+// The error returned if all attempts made so far failed.
+// Only idempotent requests (GET, HEAD, OPTIONS, TRACE, PUT and DELETE) hedged, the body replayed with GetBody,
+// requests with a body but without GetBody sent once.
+// Middlewares placed before Hedge in the chain, i.e. MaxConcurrent or a rate limiter, see each attempt,
+// placed after it see the request once.
+func Hedge(delay time.Duration, maxExtra int) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if maxExtra <= 0 || !idempotent(req.Method) ||
+				(req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+				return next.RoundTrip(req)
+			}
+
+			type result struct {
+				resp *http.Response
+				err  error
+				idx  int
+			}
+			results := make(chan result, maxExtra+1) // buffered, attempts never block
+			cancels := make([]context.CancelFunc, 0, maxExtra+1)
+			launch := func() {
+				ctx, cancel := context.WithCancel(req.Context())
+				idx := len(cancels)
+				cancels = append(cancels, cancel)
+				r := req.Clone(ctx) // headers copied, as attempts run concurrently
+				if idx > 0 && req.GetBody != nil {
+					body, err := req.GetBody()
+					if err != nil {
+						results <- result{err: fmt.Errorf("get body: %w", err), idx: idx}
+						return
+					}
+					r.Body = body
+				}
+				go func() {
+					resp, err := next.RoundTrip(r)
+					results <- result{resp: resp, err: err, idx: idx}
+				}()
+			}
+
+			launch()
+			pending := 1
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+					launch()
+					pending++
+					if len(cancels) <= maxExtra {
+						timer.Reset(delay)
+					}
+				case res := <-results:
+					pending--
+					if res.err != nil {
+						cancels[res.idx]()
+						if pending > 0 {
+							continue // wait for other attempts
+						}
+						return nil, res.err
+					}
+
+					for i, cancel := range cancels {
+						if i != res.idx {
+							cancel()
+						}
+					}
+					go func(n int) { // discard responses of canceled attempts
+						for i := 0; i < n; i++ {
+							if r := <-results; r.resp != nil && r.resp.Body != nil {
+								_ = r.resp.Body.Close()
+							}
+						}
+					}(pending)
+					if res.resp.Body != nil {
+						res.resp.Body = cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.idx]}
+					} else {
+						cancels[res.idx]()
+					}
+					return res.resp, nil
+				}
+			}
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose releases the context of the winning attempt once its body closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
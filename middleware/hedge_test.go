@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestHedge(t *testing.T) {
+	var count int32
+	canceled := make(chan int, 10)
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		n := int(atomic.AddInt32(&count, 1))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if n == 1 { // the first attempt is slow
+			select {
+			case <-r.Context().Done():
+				canceled <- n
+				return nil, r.Context().Err()
+			case <-time.After(time.Second):
+			}
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("resp-" + string(body)))}, nil
+	}}
+
+	t.Run("hedged wins", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("PUT", "http://example.com/blah", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		st := time.Now()
+		resp, err := Hedge(50*time.Millisecond, 2)(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Less(t, time.Since(st), 500*time.Millisecond, "fast response won")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "resp-body", string(body), "body replayed")
+		require.NoError(t, resp.Body.Close())
+
+		select {
+		case n := <-canceled:
+			assert.Equal(t, 1, n, "slow attempt canceled")
+		case <-time.After(time.Second):
+			t.Fatal("slow attempt not canceled")
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&count), "no more attempts after the winner")
+	})
+
+	t.Run("not hedged if fast", func(t *testing.T) {
+		fast := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		}}
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = Hedge(50*time.Millisecond, 2)(fast).RoundTrip(req)
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, 1, fast.Calls())
+	})
+
+	t.Run("not idempotent", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		st := time.Now()
+		_, err = Hedge(10*time.Millisecond, 2)(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(st), time.Second, "slow response waited")
+		assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		failing := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			time.Sleep(30 * time.Millisecond)
+			return nil, errors.New("failed")
+		}}
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = Hedge(10*time.Millisecond, 2)(failing).RoundTrip(req)
+		require.EqualError(t, err, "failed")
+		assert.Equal(t, 3, failing.Calls())
+	})
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForceHTTPS middleware rewrites http urls to https, the default port 80 dropped. Hosts listed in allowHTTP,
+// i.e. "localhost", stay http. The caller's request url not modified.
+func ForceHTTPS(allowHTTP ...string) RoundTripperHandler {
+	allowed := func(host string) bool {
+		for _, h := range allowHTTP {
+			if strings.EqualFold(h, host) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if req.URL.Scheme != "http" || allowed(req.URL.Hostname()) {
+				return next.RoundTrip(req)
+			}
+
+			u := *req.URL
+			u.Scheme = "https"
+			if host, port, err := net.SplitHostPort(u.Host); err == nil && port == "80" {
+				u.Host = host
+				if strings.Contains(host, ":") { // ipv6
+					u.Host = "[" + host + "]"
+				}
+			}
+			r := req.WithContext(req.Context()) // shallow copy
+			r.URL = &u
+			if r.Host == req.URL.Host {
+				r.Host = u.Host
+			}
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestForceHTTPS(t *testing.T) {
+	var sent []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		sent = append(sent, r.URL.String()+" "+r.Host)
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	h := ForceHTTPS("localhost", "127.0.0.1")(rmock)
+
+	tbl := []struct {
+		url, sent string
+	}{
+		{"http://example.com/blah?k=v", "https://example.com/blah?k=v example.com"},
+		{"http://example.com:80/blah", "https://example.com/blah example.com"},
+		{"http://example.com:8080/blah", "https://example.com:8080/blah example.com:8080"},
+		{"http://[::1]:80/blah", "https://[::1]/blah [::1]"},
+		{"https://example.com/blah", "https://example.com/blah example.com"},
+		{"http://localhost:8080/blah", "http://localhost:8080/blah localhost:8080"},
+		{"http://LOCALHOST/blah", "http://LOCALHOST/blah LOCALHOST"},
+		{"http://127.0.0.1/blah", "http://127.0.0.1/blah 127.0.0.1"},
+	}
+
+	for _, tt := range tbl {
+		sent = nil
+		req, err := http.NewRequest("GET", tt.url, http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(sent))
+		assert.Equal(t, tt.sent, sent[0])
+		assert.Equal(t, tt.url, req.URL.String(), "caller's url not modified")
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// InitialJitter middleware delays the very first request by a random duration up to maxDelay, spreading the initial
+// load of many instances started at the same time. Other requests, including concurrent with the first one, not delayed.
+// The delayed request fails if its context canceled.
+func InitialJitter(maxDelay time.Duration) RoundTripperHandler {
+	var started int32
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if maxDelay <= 0 || !atomic.CompareAndSwapInt32(&started, 0, 1) {
+				return next.RoundTrip(req)
+			}
+
+			timer := time.NewTimer(time.Duration(rand.Int63n(int64(maxDelay)))) // nolint
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				return nil, fmt.Errorf("initial jitter: %w", req.Context().Err())
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// Throttle middleware delays each request by a random duration in [minDelay, maxDelay], for gentle load shaping
+// against fragile upstreams. The delayed request fails if its context canceled.
+func Throttle(minDelay, maxDelay time.Duration) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			delay := minDelay
+			if maxDelay > minDelay {
+				delay += time.Duration(rand.Int63n(int64(maxDelay-minDelay) + 1)) // nolint
+			}
+			if delay <= 0 {
+				return next.RoundTrip(req)
+			}
+
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				return nil, fmt.Errorf("throttle: %w", req.Context().Err())
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestInitialJitter(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	var delays []time.Duration
+	for i := 0; i < 10; i++ {
+		h := InitialJitter(50 * time.Millisecond)
+		for j := 0; j < 3; j++ {
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			st := time.Now()
+			resp, err := h(rmock).RoundTrip(req) // handler applied per request, as done by Requester.Do
+			require.NoError(t, err)
+			assert.Equal(t, 201, resp.StatusCode)
+			if j == 0 {
+				delays = append(delays, time.Since(st))
+				continue
+			}
+			assert.Less(t, time.Since(st), 20*time.Millisecond, "only the first request delayed")
+		}
+	}
+	assert.Equal(t, 30, rmock.Calls())
+
+	var total time.Duration
+	for _, d := range delays {
+		assert.Less(t, d, 70*time.Millisecond, "delayed within the window")
+		total += d
+	}
+	assert.Greater(t, total, 50*time.Millisecond, "first requests delayed, %v", delays)
+}
+
+func TestInitialJitter_Canceled(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 201}, nil
+	}}
+	h := InitialJitter(time.Hour)(rmock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	st := time.Now()
+	_, err = h.RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, time.Since(st), time.Second)
+	assert.Equal(t, 0, rmock.Calls())
+
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err, "not delayed after the first one")
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestThrottle(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 201}, nil
+	}}
+	h := Throttle(20*time.Millisecond, 40*time.Millisecond)(rmock)
+
+	for i := 0; i < 5; i++ {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		st := time.Now()
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+		elapsed := time.Since(st)
+		assert.True(t, elapsed >= 20*time.Millisecond, "delayed at least min, %v", elapsed)
+		assert.True(t, elapsed < 80*time.Millisecond, "delayed about max at most, %v", elapsed)
+	}
+	assert.Equal(t, 5, rmock.Calls())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	st := time.Now()
+	_, err = Throttle(time.Second, 2*time.Second)(rmock).RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.True(t, time.Since(st) < 500*time.Millisecond, "canceled without full delay")
+	assert.Equal(t, 5, rmock.Calls())
+}
@@ -0,0 +1,36 @@
+package logger
+
+// Level defines the level of the leveled logger used by FromLeveled adapter
+type Level int
+
+// enum of Level
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// LeveledLogger defines printf-style leveled logger, matching *zap.SugaredLogger and *logrus.Logger
+// (as well as logrus.FieldLogger), so the adapter doesn't pull the dependencies.
+type LeveledLogger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// FromLeveled makes Service logging to the leveled logger at the given level, i.e. *zap.SugaredLogger,
+// *logrus.Logger or *logrus.Entry. Unknown levels logged as Info.
+func FromLeveled(l LeveledLogger, level Level) Service {
+	switch level {
+	case LevelDebug:
+		return Func(l.Debugf)
+	case LevelWarn:
+		return Func(l.Warnf)
+	case LevelError:
+		return Func(l.Errorf)
+	default:
+		return Func(l.Infof)
+	}
+}
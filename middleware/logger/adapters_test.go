@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+// fakeLeveled records messages with levels, the same way *zap.SugaredLogger and *logrus.Logger would log them
+type fakeLeveled struct {
+	lines []string
+}
+
+func (f *fakeLeveled) Debugf(format string, args ...interface{}) { f.log("DEBUG", format, args...) }
+func (f *fakeLeveled) Infof(format string, args ...interface{})  { f.log("INFO", format, args...) }
+func (f *fakeLeveled) Warnf(format string, args ...interface{})  { f.log("WARN", format, args...) }
+func (f *fakeLeveled) Errorf(format string, args ...interface{}) { f.log("ERROR", format, args...) }
+
+func (f *fakeLeveled) log(level, format string, args ...interface{}) {
+	f.lines = append(f.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func TestFromLeveled(t *testing.T) {
+	tbl := []struct {
+		name  string
+		level Level
+		want  string
+	}{
+		{"info", LevelInfo, "INFO"},
+		{"debug", LevelDebug, "DEBUG"},
+		{"warn", LevelWarn, "WARN"},
+		{"error", LevelError, "ERROR"},
+		{"unknown level", Level(42), "INFO"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: 200}, nil
+			}}
+			fl := &fakeLeveled{}
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			_, err = New(FromLeveled(fl, tt.level)).Middleware(rmock).RoundTrip(req)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(fl.lines))
+			assert.Contains(t, fl.lines[0], tt.want+" GET http://example.com/blah")
+		})
+	}
+}
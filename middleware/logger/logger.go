@@ -3,12 +3,17 @@ package logger
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-pkgz/requester/middleware"
@@ -17,11 +22,20 @@ import (
 // Middleware for logging requests
 type Middleware struct {
 	Service
-	prefix  string
-	body    bool
-	headers bool
+	prefix        string
+	body          bool
+	headers       bool
+	bodyFormatter func(contentType string, body []byte) string
+	maxBodyLen    int
+	sampler       func() bool
+	alwaysErrors  bool
+	requestID     func(ctx context.Context) string
+	groupRetries  bool
+	fromContext   func(ctx context.Context) Service
 }
 
+const maxBodyLen = 1024
+
 // New creates logging middleware with optional parameters turning on logging elements
 func New(svc Service, opts ...func(m *Middleware)) *Middleware {
 	res := Middleware{Service: svc}
@@ -34,47 +48,229 @@ func New(svc Service, opts ...func(m *Middleware)) *Middleware {
 // Middleware request logging
 func (m Middleware) Middleware(next http.RoundTripper) http.RoundTripper {
 	fn := func(req *http.Request) (resp *http.Response, err error) {
-		st := time.Now()
-
-		logParts := []string{}
-		if m.prefix != "" {
-			logParts = append(logParts, m.prefix)
+		sampled := m.sampler == nil || m.sampler()
+		if !sampled && !m.alwaysErrors {
+			return next.RoundTrip(req)
 		}
-		logParts = append(logParts, req.Method, req.URL.String()+",")
 
-		headerLog := []byte{} // nolint
-		if m.headers {
-			if headerLog, err = json.Marshal(req.Header); err != nil {
-				headerLog = []byte(fmt.Sprintf("headers: %v", req.Header))
-			}
-			logParts = append(logParts, string(headerLog)+",")
+		if !sampled {
+			return m.logFailed(next, req)
 		}
 
+		st := time.Now()
+		svc := m.service(req.Context())
+
 		bodyLog := ""
-		if m.body && req.Body != nil {
-			body, e := io.ReadAll(req.Body)
-			if e == nil {
-				_ = req.Body.Close()
-				req.Body = io.NopCloser(bytes.NewReader(body))
-				bodyLog = " body: " + string(body)
-				if len(bodyLog) > 1024 {
-					bodyLog = bodyLog[:1024] + "..."
-				}
-				bodyLog = strings.Replace(bodyLog, "\n", " ", -1)
-			}
+		if m.body {
+			bodyLog = m.requestBody(req)
 		}
-		if bodyLog != "" {
-			logParts = append(logParts, bodyLog+",")
+		logParts := m.requestParts(req, bodyLog)
+
+		attempts := 0
+		if m.groupRetries && middleware.AttemptFromContext(req.Context()) == 0 {
+			// logger placed before Repeater, gets attempts reported by the observer
+			attemptSt := time.Now()
+			obs := middleware.AttemptObserver(func(attempt int, resp *http.Response, err error) {
+				attempts = attempt
+				svc.Logf(strings.Join(append(logParts, fmt.Sprintf("attempt=%d, %s, time: %v", attempt, outcome(resp, err),
+					time.Since(attemptSt))), " "))
+				attemptSt = time.Now()
+			})
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CtxAttemptObserver, obs))
 		}
+
 		resp, err = next.RoundTrip(req)
+		if attempts > 0 {
+			logParts = append(logParts, fmt.Sprintf("attempts=%d, %s,", attempts, outcome(resp, err)))
+		}
 		logParts = append(logParts, fmt.Sprintf("time: %v", time.Since(st)))
-		m.Logf(strings.Join(logParts, " "))
+		svc.Logf(strings.Join(logParts, " "))
 		return resp, err
-
 	}
 	return middleware.RoundTripperFunc(fn)
 }
 
+// logFailed sends the request skipped by the sampler and logs it only if failed. Nothing formatted upfront, the body
+// made by GetBody on failure if set, otherwise captured up to the logged length while the transport sends it.
+func (m Middleware) logFailed(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	st := time.Now()
+	var captured *capBuffer
+	if m.body && req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		captured = &capBuffer{limit: m.bodyLimit() + 1} // one extra byte to detect truncation
+		r := req.WithContext(req.Context())
+		r.Body = teeBody{Reader: io.TeeReader(req.Body, captured), Closer: req.Body}
+		req = r
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err == nil && resp.StatusCode < 500 {
+		return resp, nil
+	}
+
+	bodyLog := ""
+	switch {
+	case !m.body:
+	case captured != nil:
+		if body := captured.bytes(); len(body) > 0 { // nothing captured if the transport failed before sending
+			bodyLog = m.formatBody(req.Header.Get("Content-Type"), body)
+		}
+	default:
+		bodyLog = m.requestBody(req)
+	}
+	logParts := m.requestParts(req, bodyLog)
+	logParts = append(logParts, fmt.Sprintf("time: %v", time.Since(st)))
+	m.service(req.Context()).Logf(strings.Join(logParts, " "))
+	return resp, err
+}
+
+// requestParts makes the request part of the log line, i.e. prefix, id, method, url, headers and the formatted body
+func (m Middleware) requestParts(req *http.Request, bodyLog string) []string {
+	logParts := []string{}
+	if m.prefix != "" {
+		logParts = append(logParts, m.prefix)
+	}
+	if m.requestID != nil {
+		if id := m.requestID(req.Context()); id != "" {
+			logParts = append(logParts, "["+id+"]")
+		}
+	}
+	logParts = append(logParts, req.Method, req.URL.String()+",")
+
+	if m.headers {
+		headerLog, err := json.Marshal(req.Header)
+		if err != nil {
+			headerLog = []byte(fmt.Sprintf("headers: %v", req.Header))
+		}
+		logParts = append(logParts, string(headerLog)+",")
+	}
+	if bodyLog != "" {
+		logParts = append(logParts, bodyLog+",")
+	}
+	if m.groupRetries {
+		if attempt := middleware.AttemptFromContext(req.Context()); attempt > 0 {
+			// logger placed after Repeater, sees each attempt
+			logParts = append(logParts, fmt.Sprintf("attempt=%d,", attempt))
+		}
+	}
+	return logParts
+}
+
+// requestBody returns the formatted request body, empty if it can't be read
+func (m Middleware) requestBody(req *http.Request) string {
+	body, err := readBody(req)
+	if err != nil {
+		return ""
+	}
+	return m.formatBody(req.Header.Get("Content-Type"), body)
+}
+
+// service returns logger from the request context if set by FromContext, the default one otherwise
+func (m Middleware) service(ctx context.Context) Service {
+	if m.fromContext != nil {
+		if svc := m.fromContext(ctx); svc != nil {
+			return svc
+		}
+	}
+	return m.Service
+}
+
+// outcome returns status or error of the response for the log line
+func outcome(resp *http.Response, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return "status: " + strconv.Itoa(resp.StatusCode)
+}
+
+// readBody returns the request body, the copy made by GetBody if set. Otherwise, the body read and replaced with
+// in-memory copy, so the request still carries it. Nil and http.NoBody bodies left as-is.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// formatBody makes body part of the log line with custom formatter if set, otherwise
+// newlines replaced by spaces and the body truncated
+func (m Middleware) formatBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return " body: <empty>"
+	}
+	limit := m.bodyLimit()
+	truncated := len(body) > limit
+	if truncated {
+		body = body[:limit]
+	}
+
+	if m.bodyFormatter != nil {
+		if res := m.bodyFormatter(contentType, body); res != "" {
+			return " body: " + res
+		}
+	}
+	res := " body: " + string(body)
+	if truncated {
+		res += "..."
+	}
+	return strings.Replace(res, "\n", " ", -1)
+}
+
+// bodyLimit returns max length of the logged body
+func (m Middleware) bodyLimit() int {
+	if m.maxBodyLen <= 0 {
+		return maxBodyLen
+	}
+	return m.maxBodyLen
+}
+
+// capBuffer keeps the first limit bytes written to it. Safe for concurrent use, as the transport may still
+// write the request body after the response returned.
+type capBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int
+}
+
+// Write keeps bytes up to the limit and discards the rest, never fails
+func (c *capBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if room := c.limit - len(c.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		c.buf = append(c.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// bytes returns a copy of the captured bytes
+func (c *capBuffer) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf...)
+}
+
+// teeBody is the request body copied to capBuffer as read, closes the original body
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
 // Prefix sets logging prefix for each line
 func Prefix(prefix string) func(m *Middleware) {
 	return func(m *Middleware) {
@@ -87,6 +283,69 @@ func WithBody(m *Middleware) {
 	m.body = true
 }
 
+// BodyFormatter sets custom formatting of the logged body, i.e. to pretty-print JSON, redact fields or hex-dump binaries.
+// The formatter gets request's Content-Type and the body capped to MaxBodyLen bytes. Empty result falls back to the default format.
+func BodyFormatter(fn func(contentType string, body []byte) string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.bodyFormatter = fn
+	}
+}
+
+// MaxBodyLen sets the length of logged body, the longer body truncated with "..." suffix. Default is 1024.
+func MaxBodyLen(n int) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.maxBodyLen = n
+	}
+}
+
+// Sample enables logging of a random fraction of requests, rate 0 logs nothing and 1 logs everything
+func Sample(rate float64) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.sampler = func() bool { return rand.Float64() < rate } // nolint
+	}
+}
+
+// SampleEvery enables logging of every n-th request
+func SampleEvery(n int) func(m *Middleware) {
+	return func(m *Middleware) {
+		counter := new(int64)
+		m.sampler = func() bool {
+			if n <= 1 {
+				return true
+			}
+			return (atomic.AddInt64(counter, 1)-1)%int64(n) == 0
+		}
+	}
+}
+
+// AlwaysLogErrors makes failed requests (transport errors and 5xx) logged regardless of sampling
+func AlwaysLogErrors(m *Middleware) {
+	m.alwaysErrors = true
+}
+
+// WithRequestID sets function extracting request id from the context, the id added to each logged line.
+// Can be used with middleware.RequestIDFromContext.
+func WithRequestID(fn func(ctx context.Context) string) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.requestID = fn
+	}
+}
+
+// GroupRetries annotates lines with the attempt number made by middleware.Repeater.
+// If the logger placed before Repeater (i.e. passed to requester.New after it), each attempt logged
+// as a separate line and the final line summarizes total attempts and the final status.
+func GroupRetries(m *Middleware) {
+	m.groupRetries = true
+}
+
+// FromContext sets function resolving logger from the request context, i.e. one with per-request fields like trace id.
+// The logger passed to New used if the function returns nil.
+func FromContext(fn func(ctx context.Context) Service) func(m *Middleware) {
+	return func(m *Middleware) {
+		m.fromContext = fn
+	}
+}
+
 // WithHeaders enables headers logging
 func WithHeaders(m *Middleware) {
 	m.headers = true
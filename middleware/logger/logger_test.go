@@ -2,15 +2,19 @@ package logger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/go-pkgz/requester/middleware"
 	"github.com/go-pkgz/requester/middleware/mocks"
 )
 
@@ -76,3 +80,340 @@ func TestMiddleware_HandleWithOptions(t *testing.T) {
 
 	assert.Equal(t, 1, len(loggerMock.LogfCalls()))
 }
+
+func TestMiddleware_BodyFormatter(t *testing.T) {
+	outBuf := bytes.NewBuffer(nil)
+	loggerMock := &mocks.LoggerSvc{
+		LogfFunc: func(format string, args ...interface{}) {
+			_, _ = fmt.Fprintf(outBuf, format+"\n", args...)
+		},
+	}
+	l := New(loggerMock, WithBody, BodyFormatter(func(contentType string, body []byte) string {
+		if contentType != "application/json" {
+			return "" // default formatting
+		}
+		return strings.ToUpper(string(body))
+	}))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	client := http.Client{Transport: l.Middleware(http.DefaultTransport)}
+
+	req, err := http.NewRequest("POST", ts.URL, bytes.NewBufferString(`{"key":"val"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	req, err = http.NewRequest("POST", ts.URL, bytes.NewBufferString("blah1\nblah2"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	t.Log(outBuf.String())
+	lines := strings.Split(strings.TrimSpace(outBuf.String()), "\n")
+	require.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], `body: {"KEY":"VAL"},`)
+	assert.Contains(t, lines[1], `body: blah1 blah2,`)
+}
+
+func TestMiddleware_MaxBodyLen(t *testing.T) {
+	outBuf := bytes.NewBuffer(nil)
+	loggerMock := &mocks.LoggerSvc{
+		LogfFunc: func(format string, args ...interface{}) {
+			_, _ = fmt.Fprintf(outBuf, format, args...)
+		},
+	}
+
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "1234567890abcdef", string(body), "full body sent")
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	req, err := http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("1234567890abcdef"))
+	require.NoError(t, err)
+	_, err = New(loggerMock, WithBody, MaxBodyLen(10)).Middleware(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Contains(t, outBuf.String(), "body: 1234567890...,")
+
+	outBuf.Reset()
+	req, err = http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("1234567890abcdef"))
+	require.NoError(t, err)
+	_, err = New(loggerMock, WithBody).Middleware(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Contains(t, outBuf.String(), "body: 1234567890abcdef,", "not truncated with default limit")
+}
+
+func TestMiddleware_Sample(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/err" {
+			return &http.Response{StatusCode: 500}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	run := func(path string, n int, opts ...func(m *Middleware)) int {
+		loggerMock := &mocks.LoggerSvc{LogfFunc: func(format string, args ...interface{}) {}}
+		h := New(loggerMock, opts...).Middleware(rmock)
+		for i := 0; i < n; i++ {
+			req, err := http.NewRequest("GET", "http://example.com"+path, http.NoBody)
+			require.NoError(t, err)
+			_, err = h.RoundTrip(req)
+			require.NoError(t, err)
+		}
+		return len(loggerMock.LogfCalls())
+	}
+
+	assert.Equal(t, 0, run("/blah", 100, Sample(0)))
+	assert.Equal(t, 100, run("/blah", 100, Sample(1)))
+	assert.Equal(t, 10, run("/blah", 100, SampleEvery(10)))
+	assert.Equal(t, 100, run("/blah", 100, SampleEvery(1)))
+	assert.Equal(t, 0, run("/err", 10, Sample(0)), "errors not logged without AlwaysLogErrors")
+	assert.Equal(t, 10, run("/err", 10, Sample(0), AlwaysLogErrors))
+	assert.Equal(t, 0, run("/blah", 10, Sample(0), AlwaysLogErrors))
+	assert.Equal(t, 100, run("/blah", 100), "no sampling by default")
+}
+
+func TestMiddleware_SampleSkipsBody(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		if r.URL.Path == "/err" {
+			return &http.Response{StatusCode: 500}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	var lines []string
+	var formatted int32
+	loggerMock := &mocks.LoggerSvc{LogfFunc: func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}}
+	formatter := func(contentType string, body []byte) string {
+		atomic.AddInt32(&formatted, 1)
+		return ""
+	}
+	h := New(loggerMock, WithBody, BodyFormatter(formatter), Sample(0), AlwaysLogErrors).Middleware(rmock)
+
+	t.Run("unsampled success", func(t *testing.T) {
+		lines, formatted = nil, 0
+		body := &readSpy{Reader: strings.NewReader("payload")}
+		req, err := http.NewRequest("POST", "http://example.com/blah", body)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(lines))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&formatted), "body not formatted")
+		assert.Equal(t, body, req.Body, "body not replaced")
+	})
+
+	t.Run("unsampled error with GetBody", func(t *testing.T) {
+		lines, formatted = nil, 0
+		req, err := http.NewRequest("POST", "http://example.com/err", strings.NewReader("payload"))
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(lines))
+		assert.Contains(t, lines[0], "POST http://example.com/err,  body: payload,")
+		assert.Equal(t, int32(1), atomic.LoadInt32(&formatted))
+	})
+
+	t.Run("unsampled error without GetBody", func(t *testing.T) {
+		lines, formatted = nil, 0
+		req, err := http.NewRequest("POST", "http://example.com/err", &readSpy{Reader: strings.NewReader("payload")})
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(lines))
+		assert.Contains(t, lines[0], "POST http://example.com/err,  body: payload,", "body captured while sent")
+	})
+}
+
+// readSpy is a request body without GetBody
+type readSpy struct {
+	*strings.Reader
+}
+
+func (r *readSpy) Close() error { return nil }
+
+func TestMiddleware_WithRequestID(t *testing.T) {
+	outBuf := bytes.NewBuffer(nil)
+	loggerMock := &mocks.LoggerSvc{
+		LogfFunc: func(format string, args ...interface{}) {
+			_, _ = fmt.Fprintf(outBuf, format, args...)
+		},
+	}
+
+	var sentID string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		sentID = r.Header.Get("X-Request-ID")
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	l := New(loggerMock, WithRequestID(middleware.RequestIDFromContext), Prefix("REST"))
+	h := middleware.RequestID("X-Request-ID")(l.Middleware(rmock))
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+
+	t.Log(outBuf.String())
+	require.NotEmpty(t, sentID)
+	assert.True(t, strings.HasPrefix(outBuf.String(), "REST ["+sentID+"] GET http://example.com/blah,"))
+}
+
+func TestMiddleware_GroupRetries(t *testing.T) {
+	var lines []string
+	loggerMock := &mocks.LoggerSvc{
+		LogfFunc: func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		},
+	}
+
+	var count int32
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			return &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+	l := New(loggerMock, GroupRetries)
+
+	t.Run("logger before repeater", func(t *testing.T) {
+		lines = nil
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := l.Middleware(middleware.Repeater(repeater)(rmock)).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		t.Log(strings.Join(lines, "\n"))
+		require.Equal(t, 3, len(lines))
+		assert.True(t, strings.HasPrefix(lines[0], "GET http://example.com/blah, attempt=1, status: 503, time:"))
+		assert.True(t, strings.HasPrefix(lines[1], "GET http://example.com/blah, attempt=2, status: 200, time:"))
+		assert.True(t, strings.HasPrefix(lines[2], "GET http://example.com/blah, attempts=2, status: 200, time:"))
+	})
+
+	t.Run("logger after repeater", func(t *testing.T) {
+		lines = nil
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := middleware.Repeater(repeater)(l.Middleware(rmock)).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		t.Log(strings.Join(lines, "\n"))
+		require.Equal(t, 2, len(lines))
+		assert.True(t, strings.HasPrefix(lines[0], "GET http://example.com/blah, attempt=1, time:"))
+		assert.True(t, strings.HasPrefix(lines[1], "GET http://example.com/blah, attempt=2, time:"))
+	})
+
+	t.Run("no repeater", func(t *testing.T) {
+		lines = nil
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = l.Middleware(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(lines))
+		assert.True(t, strings.HasPrefix(lines[0], "GET http://example.com/blah, time:"))
+	})
+}
+
+func TestMiddleware_FromContext(t *testing.T) {
+	type ctxKey struct{}
+	defaultLogger := &mocks.LoggerSvc{LogfFunc: func(format string, args ...interface{}) {}}
+	ctxLogger := &mocks.LoggerSvc{LogfFunc: func(format string, args ...interface{}) {}}
+
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	l := New(defaultLogger, FromContext(func(ctx context.Context) Service {
+		if svc, ok := ctx.Value(ctxKey{}).(Service); ok {
+			return svc
+		}
+		return nil
+	}))
+	h := l.Middleware(rmock)
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, Service(ctxLogger))
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ctxLogger.LogfCalls()))
+	assert.True(t, strings.HasPrefix(ctxLogger.LogfCalls()[0].Format, "GET http://example.com/blah, time:"))
+	assert.Equal(t, 0, len(defaultLogger.LogfCalls()))
+
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(ctxLogger.LogfCalls()))
+	assert.Equal(t, 1, len(defaultLogger.LogfCalls()), "default logger used without one in context")
+}
+
+func TestMiddleware_WithBodyEmpty(t *testing.T) {
+	var lines []string
+	loggerMock := &mocks.LoggerSvc{
+		LogfFunc: func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		},
+	}
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = append(received, string(body))
+		assert.Nil(t, r.TransferEncoding, "not chunked")
+	}))
+	defer ts.Close()
+	client := http.Client{Transport: New(loggerMock, WithBody).Middleware(http.DefaultTransport)}
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	req, err = http.NewRequest("GET", ts.URL, http.NoBody)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	req, err = http.NewRequest("POST", ts.URL, bytes.NewBufferString("with GetBody"))
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	req, err = http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("without GetBody")))
+	require.NoError(t, err)
+	req.ContentLength = 15
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	t.Log(strings.Join(lines, "\n"))
+	require.Equal(t, 4, len(lines))
+	assert.Contains(t, lines[0], "body: <empty>,")
+	assert.Contains(t, lines[1], "body: <empty>,")
+	assert.Contains(t, lines[2], "body: with GetBody,")
+	assert.Contains(t, lines[3], "body: without GetBody,")
+	assert.Equal(t, []string{"", "", "with GetBody", "without GetBody"}, received, "bodies sent")
+}
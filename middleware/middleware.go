@@ -3,6 +3,7 @@ package middleware
 
 import (
 	"net/http"
+	"strings"
 )
 
 //go:generate moq -out mocks/repeater.go -pkg mocks -skip-ensure -with-resets -fmt goimports . RepeaterSvc
@@ -18,3 +19,52 @@ type RoundTripperFunc func(*http.Request) (*http.Response, error)
 
 // RoundTrip adopts function to the type
 func (rt RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return rt(r) }
+
+// Identity is a no-op middleware passing requests to the next handler as-is
+func Identity(next http.RoundTripper) http.RoundTripper { return next }
+
+// If returns mw if cond is true and Identity otherwise, for conditional chains, i.e. logging in debug mode only
+func If(cond bool, mw RoundTripperHandler) RoundTripperHandler {
+	if cond {
+		return mw
+	}
+	return Identity
+}
+
+// OnlyMethods applies mw to requests with the listed methods only, i.e. "GET" for Cache.
+// Requests with other methods passed to the next handler as-is.
+func OnlyMethods(mw RoundTripperHandler, methods ...string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		wrapped := mw(next)
+		fn := func(req *http.Request) (*http.Response, error) {
+			for _, m := range methods {
+				if strings.EqualFold(m, req.Method) {
+					return wrapped.RoundTrip(req)
+				}
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// Chain combines middlewares into one, applied in the same order as passed to requester.New.
+// The last middleware is the outermost one.
+func Chain(mws ...RoundTripperHandler) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		for _, mw := range mws {
+			next = mw(next)
+		}
+		return next
+	}
+}
+
+// Wrap makes middleware from a single function receiving the next RoundTripper explicitly,
+// to avoid the boilerplate of the handler returning RoundTripperFunc
+func Wrap(fn func(req *http.Request, next http.RoundTripper) (*http.Response, error)) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return fn(req, next)
+		})
+	}
+}
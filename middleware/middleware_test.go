@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestIf(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	assert.Equal(t, rmock, If(false, Header("k", "v"))(rmock), "passthrough")
+	assert.Equal(t, rmock, Identity(rmock))
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = If(false, Header("k", "v"))(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "", req.Header.Get("k"))
+
+	_, err = If(true, Header("k", "v"))(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "v", req.Header.Get("k"))
+	assert.Equal(t, 2, rmock.Calls())
+}
+
+func TestOnlyMethods(t *testing.T) {
+	var headers []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		headers = append(headers, r.Method+":"+r.Header.Get("k"))
+		return &http.Response{StatusCode: 201}, nil
+	}}
+	h := OnlyMethods(Header("k", "v"), "POST", "put")(rmock)
+
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+		req, err := http.NewRequest(method, "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+	assert.Equal(t, []string{"GET:", "POST:v", "PUT:v", "DELETE:"}, headers)
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) RoundTripperHandler {
+		return func(next http.RoundTripper) http.RoundTripper {
+			fn := func(r *http.Request) (*http.Response, error) {
+				calls = append(calls, name)
+				return next.RoundTrip(r)
+			}
+			return RoundTripperFunc(fn)
+		}
+	}
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		calls = append(calls, "transport")
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := Chain(mw("a"), mw("b"), If(false, mw("c")), mw("d"))(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"d", "b", "a", "transport"}, calls)
+
+	assert.Equal(t, rmock, Chain()(rmock), "empty chain is a passthrough")
+}
+
+func TestWrap(t *testing.T) {
+	var headers []http.Header
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		headers = append(headers, r.Header.Clone())
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	handRolled := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			r.Header.Set("X-Custom", r.Method+" "+r.URL.Path)
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+	wrapped := Wrap(func(r *http.Request, next http.RoundTripper) (*http.Response, error) {
+		r.Header.Set("X-Custom", r.Method+" "+r.URL.Path)
+		return next.RoundTrip(r)
+	})
+
+	for _, h := range []RoundTripperHandler{handRolled, wrapped} {
+		req, err := http.NewRequest("POST", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+	require.Equal(t, 2, len(headers))
+	assert.Equal(t, http.Header{"X-Custom": {"POST /blah"}}, headers[1])
+	assert.Equal(t, headers[0], headers[1], "same as hand-rolled")
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// Nonce middleware sets a unique nonce header, generated by gen or random 32 hex chars if gen is nil.
+// The header kept if already set, so the nonce stays the same for all attempts of the request repeated by Repeater,
+// including repeats with RepeaterAttemptHeader.
+// Unlike RequestID, the nonce is not stored in the context and intended for signature freshness checks.
+func Nonce(header string, gen func() string) RoundTripperHandler {
+	if gen == nil {
+		gen = newRequestID
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get(header) == "" {
+				req.Header.Set(header, gen())
+			}
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
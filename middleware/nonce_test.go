@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestNonce(t *testing.T) {
+	var nonces []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		nonces = append(nonces, r.Header.Get("X-Nonce"))
+		if len(nonces)%3 != 0 {
+			return &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+
+	t.Run("stable across repeats", func(t *testing.T) {
+		nonces = nil
+		h := Repeater(repeater)(Nonce("X-Nonce", nil)(rmock)) // nonce set by each attempt
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			resp, err := h.RoundTrip(req)
+			require.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+		require.Equal(t, 6, len(nonces))
+		assert.Regexp(t, regexp.MustCompile("^[0-9a-f]{32}$"), nonces[0])
+		assert.Equal(t, []string{nonces[0], nonces[0], nonces[0]}, nonces[:3], "same nonce for all attempts")
+		assert.Equal(t, []string{nonces[3], nonces[3], nonces[3]}, nonces[3:], "same nonce for all attempts")
+		assert.NotEqual(t, nonces[0], nonces[3], "different requests, different nonces")
+	})
+
+	t.Run("stable across repeats with attempt header", func(t *testing.T) {
+		nonces = nil
+		h := RepeaterWithOptions(repeater, RepeaterAttemptHeader("X-Retry-Attempt"))(Nonce("X-Nonce", nil)(rmock))
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		require.Equal(t, 3, len(nonces))
+		assert.Regexp(t, regexp.MustCompile("^[0-9a-f]{32}$"), nonces[0])
+		assert.Equal(t, []string{nonces[0], nonces[0], nonces[0]}, nonces, "same nonce for all attempts")
+	})
+
+	t.Run("custom generator", func(t *testing.T) {
+		nonces = nil
+		var counter int32
+		gen := func() string { return "n-" + strconv.Itoa(int(atomic.AddInt32(&counter, 1))) }
+		h := Nonce("X-Nonce", gen)(Repeater(repeater)(rmock))
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			_, err = h.RoundTrip(req)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, []string{"n-1", "n-1", "n-1", "n-2", "n-2", "n-2"}, nonces)
+	})
+
+	t.Run("set by caller", func(t *testing.T) {
+		nonces = nil
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("X-Nonce", "caller")
+		_, err = Nonce("X-Nonce", nil)(Repeater(repeater)(rmock)).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"caller", "caller", "caller"}, nonces)
+	})
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// ProxyRotate middleware picks a proxy for each request from the list in round-robin order and stores it in the request
+// context with CtxProxy key. Proxy is a transport-level setting, so the base transport should use ProxyFromContext,
+// i.e. &http.Transport{Proxy: middleware.ProxyFromContext}. The transport pools connections per proxy.
+func ProxyRotate(proxies ...*url.URL) RoundTripperHandler {
+	var counter uint64
+	return proxySelect(len(proxies), func() *url.URL {
+		n := atomic.AddUint64(&counter, 1) - 1
+		return proxies[n%uint64(len(proxies))]
+	})
+}
+
+// ProxyRandom is the same as ProxyRotate, but picks a random proxy for each request
+func ProxyRandom(proxies ...*url.URL) RoundTripperHandler {
+	return proxySelect(len(proxies), func() *url.URL {
+		return proxies[rand.Intn(len(proxies))] // nolint
+	})
+}
+
+func proxySelect(count int, pick func() *url.URL) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if count == 0 {
+				return next.RoundTrip(req)
+			}
+			return next.RoundTrip(req.WithContext(context.WithValue(req.Context(), CtxProxy, pick())))
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// ProxyFromContext returns the proxy set by ProxyRotate or ProxyRandom, to be used as http.Transport's Proxy.
+// Falls back to http.ProxyFromEnvironment if not set.
+func ProxyFromContext(req *http.Request) (*url.URL, error) {
+	if proxy, ok := req.Context().Value(CtxProxy).(*url.URL); ok {
+		return proxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
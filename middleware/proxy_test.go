@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyRotate(t *testing.T) {
+	var lock sync.Mutex
+	var used []string
+	fakeProxy := func(name string) (*httptest.Server, *url.URL) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "http://example.com/blah", r.URL.String(), "absolute url sent to proxy")
+			lock.Lock()
+			used = append(used, name)
+			lock.Unlock()
+			_, err := w.Write([]byte(name))
+			require.NoError(t, err)
+		}))
+		u, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+		return ts, u
+	}
+	ts1, p1 := fakeProxy("p1")
+	defer ts1.Close()
+	ts2, p2 := fakeProxy("p2")
+	defer ts2.Close()
+
+	get := func(h http.RoundTripper) string {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		used = nil
+		h := ProxyRotate(p1, p2)(&http.Transport{Proxy: ProxyFromContext})
+		var res []string
+		for i := 0; i < 5; i++ {
+			res = append(res, get(h))
+		}
+		assert.Equal(t, []string{"p1", "p2", "p1", "p2", "p1"}, res)
+		assert.Equal(t, res, used)
+	})
+
+	t.Run("round-robin, concurrent", func(t *testing.T) {
+		used = nil
+		h := ProxyRotate(p1, p2)(&http.Transport{Proxy: ProxyFromContext})
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				get(h)
+			}()
+		}
+		wg.Wait()
+		counts := map[string]int{}
+		for _, u := range used {
+			counts[u]++
+		}
+		assert.Equal(t, map[string]int{"p1": 5, "p2": 5}, counts)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		used = nil
+		h := ProxyRandom(p1, p2)(&http.Transport{Proxy: ProxyFromContext})
+		for i := 0; i < 20; i++ {
+			res := get(h)
+			assert.Contains(t, []string{"p1", "p2"}, res)
+		}
+		assert.Equal(t, 20, len(used))
+	})
+
+	t.Run("no proxies", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := w.Write([]byte("direct"))
+			require.NoError(t, err)
+		}))
+		defer ts.Close()
+		req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+		require.NoError(t, err)
+		resp, err := ProxyRotate()(&http.Transport{Proxy: ProxyFromContext}).RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "direct", string(body))
+	})
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ErrTooManyRedirects returned by MaxRedirects middleware if the redirect limit exceeded
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// MaxRedirects middleware follows redirects inside the chain, up to maxRedirects times.
+// The returned response's Request.URL is the final URL. 301, 302 and 303 change the method to GET
+// (HEAD kept as-is) and drop the body, 307 and 308 preserve method and body, replayed with GetBody.
+// Sensitive headers (authorization and cookies) are not forwarded to a different host.
+// The redirect response returned as-is if it can't be followed, i.e. no Location or the body can't be replayed.
+func MaxRedirects(maxRedirects int) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			r := req
+			for redirects := 0; ; redirects++ {
+				resp, err := next.RoundTrip(r)
+				if err != nil || !isRedirect(resp.StatusCode) {
+					return resp, err
+				}
+				loc := resp.Header.Get("Location")
+				if loc == "" {
+					return resp, nil
+				}
+				u, err := r.URL.Parse(loc)
+				if err != nil {
+					return resp, nil // invalid location, let the caller handle the redirect response
+				}
+				nr, ok, err := redirectRequest(r, resp.StatusCode, u)
+				if err != nil {
+					_ = resp.Body.Close()
+					return nil, err
+				}
+				if !ok {
+					return resp, nil
+				}
+				if redirects >= maxRedirects {
+					_ = resp.Body.Close()
+					if nr.Body != nil {
+						_ = nr.Body.Close() // replayed body not sent
+					}
+					return nil, fmt.Errorf("stopped after %d redirects: %w", maxRedirects, ErrTooManyRedirects)
+				}
+				_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) // allow connection reuse
+				_ = resp.Body.Close()
+				r = nr
+			}
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectRequest makes the follow-up request for redirect, returns false if redirect can't be followed
+func redirectRequest(r *http.Request, code int, u *url.URL) (*http.Request, bool, error) {
+	nr := r.Clone(r.Context())
+	nr.URL, nr.Host = u, ""
+
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			nr.Method = http.MethodGet
+		}
+		nr.Body, nr.GetBody, nr.ContentLength = nil, nil, 0
+		nr.Header.Del("Content-Type")
+		nr.Header.Del("Content-Length")
+	default: // 307 and 308 preserve method and body
+		if r.Body != nil && r.Body != http.NoBody {
+			if r.GetBody == nil {
+				return nil, false, nil
+			}
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, false, fmt.Errorf("redirect get body: %w", err)
+			}
+			nr.Body = body
+		}
+	}
+
+	if u.Host != r.URL.Host {
+		for _, h := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+			nr.Header.Del(h)
+		}
+	}
+	return nr, true, nil
+}
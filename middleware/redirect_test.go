@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestMaxRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusTemporaryRedirect)
+		case "/post":
+			http.Redirect(w, r, "/c", http.StatusPermanentRedirect)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			_, err = w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+			require.NoError(t, err)
+		}
+	}))
+	defer ts.Close()
+
+	t.Run("chain terminated with 200", func(t *testing.T) {
+		req, err := http.NewRequest("POST", ts.URL+"/a", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		resp, err := MaxRedirects(5)(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, ts.URL+"/c", resp.Request.URL.String(), "final url")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "GET /c ", string(body), "302 changed method to GET, body dropped")
+	})
+
+	t.Run("308 preserves method and body", func(t *testing.T) {
+		req, err := http.NewRequest("POST", ts.URL+"/post", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		resp, err := MaxRedirects(5)(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "POST /c body", string(body))
+	})
+
+	t.Run("too many redirects", func(t *testing.T) {
+		req, err := http.NewRequest("GET", ts.URL+"/loop", http.NoBody)
+		require.NoError(t, err)
+		_, err = MaxRedirects(3)(http.DefaultTransport).RoundTrip(req)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrTooManyRedirects))
+
+		client := http.Client{Transport: MaxRedirects(3)(http.DefaultTransport)}
+		_, err = client.Get(ts.URL + "/loop")
+		assert.True(t, errors.Is(err, ErrTooManyRedirects), "detectable through http.Client")
+	})
+
+	t.Run("no redirects allowed", func(t *testing.T) {
+		req, err := http.NewRequest("GET", ts.URL+"/a", http.NoBody)
+		require.NoError(t, err)
+		_, err = MaxRedirects(0)(http.DefaultTransport).RoundTrip(req)
+		assert.True(t, errors.Is(err, ErrTooManyRedirects))
+	})
+}
+
+func TestMaxRedirects_BodiesClosed(t *testing.T) {
+	var respClosed bool
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		body := &closeSpy{Reader: strings.NewReader("redirect"), onClose: func(int) { respClosed = true }}
+		return &http.Response{StatusCode: http.StatusTemporaryRedirect, Header: http.Header{"Location": {"/next"}},
+			Body: body}, nil
+	}}
+
+	t.Run("get body failed", func(t *testing.T) {
+		respClosed = false
+		req, err := http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		req.GetBody = func() (io.ReadCloser, error) { return nil, errors.New("get body failed") }
+		_, err = MaxRedirects(3)(rmock).RoundTrip(req)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "get body failed")
+		assert.True(t, respClosed, "redirect response closed")
+	})
+
+	t.Run("limit reached", func(t *testing.T) {
+		respClosed = false
+		replayed, replayedClosed := 0, 0
+		req, err := http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("body"))
+		require.NoError(t, err)
+		req.GetBody = func() (io.ReadCloser, error) {
+			replayed++
+			return &closeSpy{Reader: strings.NewReader("body"), onClose: func(int) { replayedClosed++ }}, nil
+		}
+		_, err = MaxRedirects(0)(rmock).RoundTrip(req)
+		require.True(t, errors.Is(err, ErrTooManyRedirects))
+		assert.True(t, respClosed, "redirect response closed")
+		assert.Equal(t, 1, replayed)
+		assert.Equal(t, 1, replayedClosed, "replayed body closed")
+	})
+}
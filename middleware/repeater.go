@@ -1,10 +1,15 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 // RepeaterSvc defines repeater interface
@@ -12,40 +17,425 @@ type RepeaterSvc interface {
 	Do(ctx context.Context, fun func() error, errs ...error) (err error)
 }
 
-// Repeater sets middleware with provided RepeaterSvc to retry failed requests
+// ErrBodyNotReplayable returned by Repeater with RepeaterRequireReplayable for requests which body can't be replayed
+var ErrBodyNotReplayable = errors.New("request body can't be replayed")
+
+// RepeaterErrorKind defines the nature of the last failure of the repeated request
+type RepeaterErrorKind int
+
+// enum of RepeaterErrorKind
+const (
+	RepeaterErrTransport RepeaterErrorKind = iota // request failed, no response
+	RepeaterErrStatus                             // response with failed status or matched RepeaterRetryIf
+)
+
+// RepeaterError returned by Repeater when repeats exhausted or stopped
+type RepeaterError struct {
+	Kind       RepeaterErrorKind
+	StatusCode int // status of the last response, 0 for RepeaterErrTransport
+	Attempts   int
+	err        error
+}
+
+func (e *RepeaterError) Error() string { return "repeater: " + e.err.Error() }
+
+// Unwrap returns the error of the last attempt
+func (e *RepeaterError) Unwrap() error { return e.err }
+
+// statusError returned by the attempt failed due to the response status
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+type repeaterDisabledKey struct{}
+
+// DisableRepeater returns derived context disabling repeats for requests made with it, i.e. on a shared requester
+func DisableRepeater(ctx context.Context) context.Context {
+	return context.WithValue(ctx, repeaterDisabledKey{}, true)
+}
+
+func repeaterDisabled(ctx context.Context) bool {
+	v, _ := ctx.Value(repeaterDisabledKey{}).(bool)
+	return v
+}
+
+// RepeaterOption defines optional parameters of RepeaterWithOptions
+type RepeaterOption func(o *repeaterOptions)
+
+type repeaterOptions struct {
+	failOnCodes []int
+	retryIf     func(resp *http.Response) bool
+	bufferBody  int64
+	replayable  bool
+	retryable   func(err error) bool
+	attemptHdr  string
+	closeIdle   bool
+	budget      *RepeaterRetryBudget
+	bodyMatch   func(body []byte) bool
+	bodyMatchSz int64
+	maxAttempts int
+}
+
+// RepeaterFailOnCodes sets status codes treated as failures, by default any 4xx or 5xx fails
+func RepeaterFailOnCodes(codes ...int) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.failOnCodes = append(o.failOnCodes, codes...)
+	}
+}
+
+// RepeaterRetryIf sets a predicate over the response, the request repeated if it returns true.
+// The response body buffered, so the predicate can read it, and restored for the caller.
+func RepeaterRetryIf(fn func(resp *http.Response) bool) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.retryIf = fn
+	}
+}
+
+// RepeaterRetryOnBodyMatch sets a matcher over the response body, the request repeated if it returns true,
+// i.e. for APIs signaling transient failures with 200 status and {"retryable": true} body. Checked for responses
+// not failed by status codes only. Up to maxSize bytes of the body buffered, larger bodies not matched.
+// The body restored for the caller.
+func RepeaterRetryOnBodyMatch(matcher func(body []byte) bool, maxSize int64) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.bodyMatch = matcher
+		o.bodyMatchSz = maxSize
+	}
+}
+
+// RepeaterBufferBody enables buffering of request bodies up to maxSize bytes, so they can be replayed on repeats.
+// Used for requests without GetBody only, larger bodies fail the request.
+func RepeaterBufferBody(maxSize int64) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.bufferBody = maxSize
+	}
+}
+
+// RepeaterRequireReplayable makes requests with body which can't be replayed, i.e. without GetBody and
+// with buffering disabled, fail with ErrBodyNotReplayable. By default such requests made with a single attempt.
+func RepeaterRequireReplayable(require bool) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.replayable = require
+	}
+}
+
+// RepeaterErrorClassifier sets a function checking if the request failed with the transport error can be repeated.
+// By default, all errors repeated except context cancellation, TLS verification and malformed url errors.
+func RepeaterErrorClassifier(fn func(err error) bool) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.retryable = fn
+	}
+}
+
+// RepeaterAttemptHeader sets the header with the number of the current retry on each attempt, i.e. "X-Retry-Attempt",
+// 0 for the first attempt. Set on a copy of the request headers, the caller's request is not changed.
+func RepeaterAttemptHeader(name string) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.attemptHdr = name
+	}
+}
+
+// RepeaterCloseIdleConnsOnError makes the repeater close idle connections of the next transport after a retryable
+// transport error, so the next attempt dials again with fresh DNS resolution, i.e. after the backend IP changed.
+// Works if the next RoundTripper supports CloseIdleConnections, like *http.Transport when Repeater is the first
+// middleware in the chain, no-op otherwise.
+func RepeaterCloseIdleConnsOnError(enable bool) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.closeIdle = enable
+	}
+}
+
+// RepeaterMaxAttempts sets the number of attempts made by RepeaterSvc, unknown to the middleware otherwise.
+// With it the number of attempts left stored in the request context, available with AttemptsRemaining.
+func RepeaterMaxAttempts(n int) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.maxAttempts = n
+	}
+}
+
+// RepeaterBudget limits repeats by the budget shared between repeaters, each repeat takes a token.
+// With the budget exhausted the request is not repeated, the failed response or the error returned as-is.
+func RepeaterBudget(b *RepeaterRetryBudget) RepeaterOption {
+	return func(o *repeaterOptions) {
+		o.budget = b
+	}
+}
+
+// RepeatableError is the default error classifier of Repeater, returns false for errors which can't be fixed by repeating:
+// context cancellation, TLS certificate verification failures and malformed urls. Timeouts and other errors retryable.
+func RepeatableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var (
+		unknownAuthErr x509.UnknownAuthorityError
+		certInvalidErr x509.CertificateInvalidError
+		hostnameErr    x509.HostnameError
+		urlErr         *url.Error
+	)
+	if errors.As(err, &unknownAuthErr) || errors.As(err, &certInvalidErr) || errors.As(err, &hostnameErr) {
+		return false
+	}
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		return false
+	}
+	return true
+}
+
+// errStopRepeats returned to RepeaterSvc as a critical error, to stop repeats on errors not worth repeating
+var errStopRepeats = errors.New("stop repeats")
+
+// Repeater sets middleware with provided RepeaterSvc to retry failed requests.
+// The attempt number stored in the request context with CtxAttempt key, AttemptObserver from the context
+// with CtxAttemptObserver key called after each attempt.
 func Repeater(repeater RepeaterSvc, failOnCodes ...int) RoundTripperHandler {
+	return RepeaterWithOptions(repeater, RepeaterFailOnCodes(failOnCodes...))
+}
+
+// RepeaterWithOptions sets middleware with provided RepeaterSvc to retry failed requests, customized by options
+func RepeaterWithOptions(repeater RepeaterSvc, opts ...RepeaterOption) RoundTripperHandler {
+	o := repeaterOptions{retryable: RepeatableError}
+	for _, opt := range opts {
+		opt(&o)
+	}
 
 	return func(next http.RoundTripper) http.RoundTripper {
 
 		fn := func(req *http.Request) (*http.Response, error) {
-			if repeater == nil {
+			if repeater == nil || repeaterDisabled(req.Context()) {
 				return next.RoundTrip(req)
 			}
+			if o.attemptHdr != "" {
+				// the caller's headers not changed, the copy shared by all attempts, so headers set
+				// by inner middlewares on the first attempt, i.e. Nonce, kept for repeats
+				hdr := req.Header.Clone()
+				if hdr == nil {
+					hdr = http.Header{}
+				}
+				req = req.WithContext(req.Context())
+				req.Header = hdr
+			}
+
+			getBody, buffered, err := o.bodyReplay(req)
+			if err != nil {
+				return nil, fmt.Errorf("repeater: %w", err)
+			}
+			if getBody == nil && req.Body != nil && req.Body != http.NoBody {
+				// body consumed by the first attempt, can't repeat
+				if o.replayable {
+					return nil, fmt.Errorf("repeater: %w", ErrBodyNotReplayable)
+				}
+				return next.RoundTrip(o.attemptRequest(req, 1))
+			}
 
 			var resp *http.Response
-			var err error
+			var stopErr error
+			attempt := 0
+			var failedResp *http.Response // failed by status, kept till it is known if repeated
+			var failedErr error
 			e := repeater.Do(req.Context(), func() error {
-				resp, err = next.RoundTrip(req)
-				if err != nil {
-					return err
+				if attempt > 0 && o.budget != nil && !o.budget.allow() {
+					// no budget to repeat, the previous failure returned to the caller as-is
+					if failedResp != nil {
+						resp, failedResp = failedResp, nil
+						return nil
+					}
+					stopErr = failedErr
+					return errStopRepeats
 				}
-				// no explicit codes provided, fail on any 4xx or 5xx
-				if len(failOnCodes) == 0 && resp.StatusCode >= 400 {
-					return errors.New(resp.Status)
+				if failedResp != nil && failedResp.Body != nil {
+					_ = failedResp.Body.Close() // failed response discarded
 				}
-				// fail on provided codes only
-				for _, fc := range failOnCodes {
-					if resp.StatusCode == fc {
-						return errors.New(resp.Status)
+				failedResp, failedErr = nil, nil
+
+				attempt++
+				r := o.attemptRequest(req, attempt)
+				if getBody != nil && (attempt > 1 || buffered) {
+					// body consumed by the previous attempt or by buffering, replay it
+					body, e := getBody()
+					if e != nil {
+						return fmt.Errorf("get body: %w", e)
 					}
+					r.Body = body
+				}
+				resp, err = next.RoundTrip(r)
+				if obs, ok := req.Context().Value(CtxAttemptObserver).(AttemptObserver); ok {
+					obs(attempt, resp, err)
+				}
+				if err != nil {
+					if o.retryable != nil && !o.retryable(err) {
+						stopErr = err
+						return errStopRepeats
+					}
+					if o.closeIdle {
+						if ci, ok := next.(interface{ CloseIdleConnections() }); ok {
+							ci.CloseIdleConnections()
+						}
+					}
+					failedErr = err
+					return err
+				}
+				if e := o.check(resp); e != nil {
+					failedResp = resp
+					return e
 				}
 				return nil
-			})
+			}, errStopRepeats)
+			if failedResp != nil && failedResp.Body != nil {
+				_ = failedResp.Body.Close() // repeats exhausted
+			}
+			if errors.Is(e, errStopRepeats) {
+				e = stopErr
+			}
 			if e != nil {
-				return nil, fmt.Errorf("repeater: %w", e)
+				var se *statusError
+				if errors.As(e, &se) {
+					return nil, &RepeaterError{Kind: RepeaterErrStatus, StatusCode: se.code, Attempts: attempt, err: e}
+				}
+				return nil, &RepeaterError{Kind: RepeaterErrTransport, Attempts: attempt, err: e}
 			}
 			return resp, nil
 		}
 		return RoundTripperFunc(fn)
 	}
 }
+
+// attemptRequest makes a shallow copy of the request for the attempt, with the attempt number in the context,
+// the number of attempts left if known and the attempt header set if enabled
+func (o repeaterOptions) attemptRequest(req *http.Request, attempt int) *http.Request {
+	ctx := context.WithValue(req.Context(), CtxAttempt, attempt)
+	if o.maxAttempts > 0 {
+		remaining := o.maxAttempts - attempt
+		if remaining < 0 {
+			remaining = 0
+		}
+		ctx = context.WithValue(ctx, CtxAttemptsRemaining, remaining)
+	}
+	r := req.WithContext(ctx)
+	if o.attemptHdr != "" {
+		r.Header.Set(o.attemptHdr, strconv.Itoa(attempt-1)) // header map copied once per request
+	}
+	return r
+}
+
+// bodyReplay returns function making a fresh copy of the request body.
+// Buffers the body if GetBody not set and buffering enabled.
+func (o repeaterOptions) bodyReplay(req *http.Request) (getBody func() (io.ReadCloser, error), buffered bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false, nil
+	}
+	if req.GetBody != nil {
+		return req.GetBody, false, nil
+	}
+	if o.bufferBody <= 0 {
+		return nil, false, nil
+	}
+	body, err := readRequestBody(req, o.bufferBody)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	return func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }, true, nil
+}
+
+// readRequestBody reads up to maxSize bytes of the body, allocating exactly once if ContentLength is known
+func readRequestBody(req *http.Request, maxSize int64) ([]byte, error) {
+	if req.ContentLength > maxSize {
+		return nil, fmt.Errorf("request body exceeds buffer limit of %d bytes", maxSize)
+	}
+
+	if req.ContentLength > 0 {
+		body := make([]byte, req.ContentLength)
+		if _, err := io.ReadFull(req.Body, body); err != nil {
+			return nil, fmt.Errorf("buffer request body: %w", err)
+		}
+		var probe [1]byte
+		if n, _ := req.Body.Read(probe[:]); n > 0 {
+			return nil, fmt.Errorf("request body longer than content length %d", req.ContentLength)
+		}
+		return body, nil
+	}
+
+	// unknown length, read up to the limit
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("buffer request body: %w", err)
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("request body exceeds buffer limit of %d bytes", maxSize)
+	}
+	return body, nil
+}
+
+// check returns error if the response should be repeated
+func (o repeaterOptions) check(resp *http.Response) error {
+	// no explicit codes provided, fail on any 4xx or 5xx
+	if len(o.failOnCodes) == 0 && resp.StatusCode >= 400 {
+		return &statusError{code: resp.StatusCode, msg: resp.Status}
+	}
+	// fail on provided codes only
+	for _, fc := range o.failOnCodes {
+		if resp.StatusCode == fc {
+			return &statusError{code: resp.StatusCode, msg: resp.Status}
+		}
+	}
+
+	if o.bodyMatch != nil {
+		matched, err := o.matchBody(resp)
+		if err != nil {
+			return err
+		}
+		if matched {
+			return &statusError{code: resp.StatusCode, msg: resp.Status + ", body matched"}
+		}
+	}
+
+	if o.retryIf != nil {
+		body, err := bufferBody(resp)
+		if err != nil {
+			return err
+		}
+		retry := o.retryIf(resp)
+		resp.Body = io.NopCloser(bytes.NewReader(body)) // restore body consumed by the predicate
+		if retry {
+			return &statusError{code: resp.StatusCode, msg: resp.Status + ", retry condition met"}
+		}
+	}
+	return nil
+}
+
+// matchBody runs the body matcher over up to bodyMatchSz bytes of the response body, restoring the body.
+// Larger bodies not matched and passed to the caller as-is.
+func (o repeaterOptions) matchBody(resp *http.Response) (bool, error) {
+	if resp.Body == nil {
+		return false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, o.bodyMatchSz+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return false, fmt.Errorf("read response body: %w", err)
+	}
+	if int64(len(body)) > o.bodyMatchSz {
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return false, nil
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return o.bodyMatch(body), nil
+}
+
+// bufferBody reads the whole response body and replaces it with in-memory copy
+func bufferBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
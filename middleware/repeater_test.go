@@ -1,10 +1,20 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,6 +79,11 @@ func TestRepeater_Failed(t *testing.T) {
 
 	_, err = h(rmock).RoundTrip(req)
 	require.EqualError(t, err, "repeater: http error")
+	var rerr *RepeaterError
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, RepeaterErrTransport, rerr.Kind)
+	assert.Equal(t, 0, rerr.StatusCode)
+	assert.Equal(t, 5, rerr.Attempts)
 
 	assert.Equal(t, 5, rmock.Calls())
 }
@@ -98,6 +113,11 @@ func TestRepeater_FailedStatus(t *testing.T) {
 		_, err = h(rmock).RoundTrip(req)
 		require.EqualError(t, err, "repeater: 400 Bad Request")
 		assert.Equal(t, 5, rmock.Calls())
+		var rerr *RepeaterError
+		require.True(t, errors.As(err, &rerr))
+		assert.Equal(t, RepeaterErrStatus, rerr.Kind)
+		assert.Equal(t, 400, rerr.StatusCode)
+		assert.Equal(t, 5, rerr.Attempts)
 	})
 
 	t.Run("with codes", func(t *testing.T) {
@@ -109,6 +129,11 @@ func TestRepeater_FailedStatus(t *testing.T) {
 		_, err = h(rmock).RoundTrip(req)
 		require.EqualError(t, err, "repeater: 400 Bad Request")
 		assert.Equal(t, 5, rmock.Calls())
+		var rerr *RepeaterError
+		require.True(t, errors.As(err, &rerr))
+		assert.Equal(t, RepeaterErrStatus, rerr.Kind)
+		assert.Equal(t, 400, rerr.StatusCode)
+		assert.Equal(t, 5, rerr.Attempts)
 	})
 
 	t.Run("no codes, no match", func(t *testing.T) {
@@ -125,3 +150,471 @@ func TestRepeater_FailedStatus(t *testing.T) {
 	})
 
 }
+
+func TestRepeater_Disabled(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+
+	req, err := http.NewRequestWithContext(DisableRepeater(context.Background()), "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := Repeater(repeater)(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+	assert.Equal(t, 1, rmock.Calls())
+	assert.Equal(t, 0, len(repeater.DoCalls()))
+}
+
+func TestRepeater_RetryIf(t *testing.T) {
+	var count int32
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{StatusCode: 200, Status: "200 OK", Header: http.Header{},
+			Body: io.NopCloser(bytes.NewBufferString("body"))}
+		if atomic.AddInt32(&count, 1) < 3 {
+			resp.Header.Set("X-Retry", "true")
+		}
+		return resp, nil
+	}}
+
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+
+	retryIf := func(resp *http.Response) bool {
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "body", string(body))
+		return resp.Header.Get("X-Retry") != ""
+	}
+
+	t.Run("retried till header removed", func(t *testing.T) {
+		h := RepeaterWithOptions(repeater, RepeaterRetryIf(retryIf))
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+
+		resp, err := h(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("X-Retry"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "body", string(body), "body restored after the predicate")
+		assert.Equal(t, 3, rmock.Calls())
+	})
+
+	t.Run("condition never cleared", func(t *testing.T) {
+		rmock.ResetCalls()
+		atomic.StoreInt32(&count, -10)
+		h := RepeaterWithOptions(repeater, RepeaterRetryIf(retryIf))
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+
+		_, err = h(rmock).RoundTrip(req)
+		require.EqualError(t, err, "repeater: 200 OK, retry condition met")
+		assert.Equal(t, 5, rmock.Calls())
+		var rerr *RepeaterError
+		require.True(t, errors.As(err, &rerr))
+		assert.Equal(t, 200, rerr.StatusCode)
+		assert.Equal(t, 5, rerr.Attempts)
+	})
+}
+
+func TestRepeater_ErrorClassifier(t *testing.T) {
+	var reqErr error
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return nil, reqErr
+	}}
+
+	// stops on critical errors, as github.com/go-pkgz/repeater does
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+			for _, e := range errs {
+				if errors.Is(err, e) {
+					return err
+				}
+			}
+		}
+		return err
+	}}
+
+	tbl := []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{"canceled", fmt.Errorf("request: %w", context.Canceled), 1},
+		{"timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, 5},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, 5},
+		{"unknown authority", fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}), 1},
+		{"hostname", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"}, 1},
+		{"malformed url", &url.Error{Op: "parse", URL: "bad", Err: errors.New("invalid")}, 1},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rmock.ResetCalls()
+			reqErr = tt.err
+			req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+			require.NoError(t, err)
+			_, err = Repeater(repeater)(rmock).RoundTrip(req)
+			require.Error(t, err)
+			assert.Equal(t, "repeater: "+tt.err.Error(), err.Error(), "original error returned")
+			assert.True(t, errors.Is(err, tt.err))
+			assert.Equal(t, tt.calls, rmock.Calls())
+		})
+	}
+
+	t.Run("custom classifier", func(t *testing.T) {
+		rmock.ResetCalls()
+		reqErr = errors.New("some error")
+		h := RepeaterWithOptions(repeater, RepeaterErrorClassifier(func(err error) bool { return err.Error() != "some error" }))
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = h(rmock).RoundTrip(req)
+		require.EqualError(t, err, "repeater: some error")
+		assert.Equal(t, 1, rmock.Calls())
+	})
+}
+
+func TestRepeater_RequestBody(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "request body", string(body))
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, err = w.Write([]byte("ok"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+
+	t.Run("replayed with GetBody", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", ts.URL, bytes.NewBufferString("request body"))
+		require.NoError(t, err)
+		resp, err := Repeater(repeater)(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+	})
+
+	t.Run("buffered without GetBody", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("request body")))
+		require.NoError(t, err)
+		require.Nil(t, req.GetBody)
+		resp, err := RepeaterWithOptions(repeater, RepeaterBufferBody(1024))(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+	})
+
+	t.Run("buffered with known length", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("request body")))
+		require.NoError(t, err)
+		req.ContentLength = 12
+		resp, err := RepeaterWithOptions(repeater, RepeaterBufferBody(1024))(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		req, err = http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("request body")))
+		require.NoError(t, err)
+		req.ContentLength = 5
+		_, err = RepeaterWithOptions(repeater, RepeaterBufferBody(1024))(http.DefaultTransport).RoundTrip(req)
+		require.EqualError(t, err, "repeater: request body longer than content length 5")
+	})
+
+	t.Run("not replayable, single attempt", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("request body")))
+		require.NoError(t, err)
+		resp, err := Repeater(repeater)(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+	})
+
+	t.Run("not replayable, required", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("request body")))
+		require.NoError(t, err)
+		_, err = RepeaterWithOptions(repeater, RepeaterRequireReplayable(true))(http.DefaultTransport).RoundTrip(req)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrBodyNotReplayable))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&count))
+
+		req, err = http.NewRequest("POST", ts.URL, bytes.NewBufferString("request body"))
+		require.NoError(t, err)
+		resp, err := RepeaterWithOptions(repeater, RepeaterRequireReplayable(true))(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err, "replayable with GetBody")
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("too large to buffer", func(t *testing.T) {
+		atomic.StoreInt32(&count, 0)
+		req, err := http.NewRequest("POST", ts.URL, io.NopCloser(bytes.NewBufferString("request body")))
+		require.NoError(t, err)
+		_, err = RepeaterWithOptions(repeater, RepeaterBufferBody(5))(http.DefaultTransport).RoundTrip(req)
+		require.EqualError(t, err, "repeater: request body exceeds buffer limit of 5 bytes")
+		assert.Equal(t, int32(0), atomic.LoadInt32(&count))
+	})
+}
+
+func BenchmarkRepeater_BufferBody(b *testing.B) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) error {
+		return fun()
+	}}
+	h := RepeaterWithOptions(repeater, RepeaterBufferBody(2*1024*1024))(rmock)
+	payload := bytes.Repeat([]byte("x"), 1024*1024)
+
+	run := func(b *testing.B, contentLength int64) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			req, err := http.NewRequest("POST", "http://example.com/blah", io.NopCloser(bytes.NewReader(payload)))
+			require.NoError(b, err)
+			req.ContentLength = contentLength
+			if _, err = h.RoundTrip(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("known length", func(b *testing.B) { run(b, int64(len(payload))) })
+	b.Run("unknown length", func(b *testing.B) { run(b, -1) })
+}
+
+func TestRepeater_AttemptHeader(t *testing.T) {
+	var headers []string
+	calls := 0
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		headers = append(headers, r.Header.Get("X-Retry-Attempt"))
+		calls++
+		if calls < 3 {
+			return &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+	h := RepeaterWithOptions(repeater, RepeaterAttemptHeader("X-Retry-Attempt"))(rmock)
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Retry-Attempt", "stale")
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"0", "1", "2"}, headers)
+	assert.Equal(t, "stale", req.Header.Get("X-Retry-Attempt"), "caller's request not changed")
+
+	headers = nil
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0"}, headers, "reused transport starts from 0")
+	assert.Equal(t, "", req.Header.Get("X-Retry-Attempt"))
+
+	// headers set by inner middlewares on the first attempt kept for repeats
+	var nonces []string
+	calls = 0
+	headers = nil
+	spy := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			nonces = append(nonces, r.Header.Get("X-Nonce"))
+			return next.RoundTrip(r)
+		})
+	}
+	h = RepeaterWithOptions(repeater, RepeaterAttemptHeader("X-Retry-Attempt"))(Nonce("X-Nonce", nil)(spy(rmock)))
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"0", "1", "2"}, headers)
+	require.Equal(t, 3, len(nonces))
+	assert.NotEmpty(t, nonces[0])
+	assert.Equal(t, []string{nonces[0], nonces[0], nonces[0]}, nonces, "same nonce for all attempts")
+	assert.Equal(t, "", req.Header.Get("X-Nonce"), "caller's request not changed")
+}
+
+func TestRepeater_AttemptsRemaining(t *testing.T) {
+	var remaining []int
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}}
+	// custom middleware inside of the repeater reading the attempts left
+	spy := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			left, ok := AttemptsRemaining(req.Context())
+			require.True(t, ok)
+			remaining = append(remaining, left)
+			return next.RoundTrip(req)
+		})
+	}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+	h := RepeaterWithOptions(repeater, RepeaterMaxAttempts(5))(spy(rmock))
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	require.Error(t, err)
+	assert.Equal(t, []int{4, 3, 2, 1, 0}, remaining)
+
+	_, ok := AttemptsRemaining(req.Context())
+	assert.False(t, ok, "not set without repeater")
+}
+
+// closeIdleTransport is a RoundTripper spying on CloseIdleConnections calls
+type closeIdleTransport struct {
+	events   []string
+	fails    int
+	attempts int
+}
+
+func (c *closeIdleTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	c.events = append(c.events, "attempt")
+	c.attempts++
+	if c.attempts <= c.fails {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: 200}, nil
+}
+
+func (c *closeIdleTransport) CloseIdleConnections() { c.events = append(c.events, "close idle") }
+
+func TestRepeater_CloseIdleConnsOnError(t *testing.T) {
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+
+	tr := &closeIdleTransport{fails: 2}
+	h := RepeaterWithOptions(repeater, RepeaterCloseIdleConnsOnError(true))(tr)
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{"attempt", "close idle", "attempt", "close idle", "attempt"}, tr.events)
+
+	tr = &closeIdleTransport{fails: 2}
+	h = RepeaterWithOptions(repeater)(tr)
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"attempt", "attempt", "attempt"}, tr.events, "disabled by default")
+
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}}
+	_, err = RepeaterWithOptions(repeater, RepeaterCloseIdleConnsOnError(true))(rmock).RoundTrip(req)
+	require.Error(t, err, "no-op for transport without CloseIdleConnections")
+	assert.Equal(t, 5, rmock.Calls())
+}
+
+func TestRepeater_RetryOnBodyMatch(t *testing.T) {
+	bodies := []string{`{"retryable": true}`, `{"retryable": true}`, `{"result": "ok"}`}
+	calls := 0
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		body := bodies[calls%len(bodies)]
+		calls++
+		if r.URL.Path == "/fail" {
+			return &http.Response{StatusCode: 503, Status: "503 Service Unavailable", Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+		if r.URL.Path == "/large" {
+			body = `{"retryable": true, "data": "` + strings.Repeat("x", 100) + `"}`
+		}
+		return &http.Response{StatusCode: 200, Status: "200 OK", Body: io.NopCloser(strings.NewReader(body))}, nil
+	}}
+	repeater := &mocks.RepeaterSvcMock{DoFunc: func(ctx context.Context, fun func() error, errs ...error) (err error) {
+		for i := 0; i < 5; i++ {
+			if err = fun(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}}
+	h := RepeaterWithOptions(repeater, RepeaterRetryOnBodyMatch(func(body []byte) bool {
+		return bytes.Contains(body, []byte(`"retryable": true`))
+	}, 64))(rmock)
+
+	do := func(path string) (*http.Response, error) {
+		rmock.ResetCalls()
+		calls = 0
+		req, err := http.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		require.NoError(t, err)
+		return h.RoundTrip(req)
+	}
+
+	resp, err := do("/blah")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"result": "ok"}`, string(body), "final body readable")
+	assert.Equal(t, 3, rmock.Calls())
+
+	resp, err = do("/large")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 131, "body over the cap not matched and returned whole")
+	assert.Equal(t, 1, rmock.Calls())
+
+	_, err = do("/fail")
+	require.Error(t, err)
+	var re *RepeaterError
+	require.True(t, errors.As(err, &re))
+	assert.Equal(t, 503, re.StatusCode, "status codes checked first")
+	assert.Equal(t, 5, rmock.Calls())
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// RequestID middleware sets request id header and stores the id in the request context.
+// The id taken from the context or from the header if already set, otherwise a new random id generated.
+func RequestID(header string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			id := RequestIDFromContext(req.Context())
+			if id == "" {
+				id = req.Header.Get(header)
+			}
+			if id == "" {
+				id = newRequestID()
+			}
+			if RequestIDFromContext(req.Context()) != id {
+				req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+			}
+			req.Header.Set(header, id)
+			return next.RoundTrip(req)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// RequestIDFromContext returns request id stored by RequestID middleware, empty string if not set
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	return randomHex(16)
+}
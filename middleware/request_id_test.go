@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestRequestID(t *testing.T) {
+	var ids []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, r.Header.Get("X-Request-ID"), RequestIDFromContext(r.Context()))
+		ids = append(ids, r.Header.Get("X-Request-ID"))
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	h := RequestID("X-Request-ID")(rmock)
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(ids))
+	assert.Equal(t, 32, len(ids[0]))
+	assert.NotEqual(t, ids[0], ids[1], "new id for each request")
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("X-Request-ID", "from-header")
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "from-header", ids[2])
+
+	req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, "from-context"))
+	_, err = h.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "from-context", ids[3])
+	assert.Equal(t, "", RequestIDFromContext(context.Background()))
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrRequestTooLarge returned by MaxRequestSize middleware if the request body exceeds the limit
+var ErrRequestTooLarge = errors.New("request body too large")
+
+// MaxRequestSize middleware rejects requests with body larger than maxSize bytes. Requests with known
+// ContentLength are rejected before sending, bodies of unknown length are counted as they read
+// and fail with ErrRequestTooLarge once the limit exceeded.
+func MaxRequestSize(maxSize int64) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if req.ContentLength > maxSize {
+				return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrRequestTooLarge, req.ContentLength, maxSize)
+			}
+			if req.Body == nil || req.Body == http.NoBody {
+				return next.RoundTrip(req)
+			}
+
+			r := req.Clone(req.Context())
+			r.Body = &limitedBody{ReadCloser: req.Body, remaining: maxSize, limit: maxSize}
+			if req.GetBody != nil {
+				r.GetBody = func() (io.ReadCloser, error) {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					return &limitedBody{ReadCloser: body, remaining: maxSize, limit: maxSize}, nil
+				}
+			}
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// EnsureContentLength middleware buffers bodies of unknown length, up to maxSize bytes, and sets ContentLength
+// and GetBody, for servers rejecting chunked uploads. Requests with known length or without body passed as-is,
+// as well as bodies larger than maxSize, sent chunked.
+func EnsureContentLength(maxSize int64) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if req.Body == nil || req.Body == http.NoBody || req.ContentLength > 0 {
+				return next.RoundTrip(req)
+			}
+
+			body, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+			if err != nil {
+				_ = req.Body.Close() // round trippers close the request body even on errors
+				return nil, fmt.Errorf("read request body: %w", err)
+			}
+			r := req.WithContext(req.Context())
+			if int64(len(body)) > maxSize {
+				r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+				return next.RoundTrip(r)
+			}
+			_ = req.Body.Close()
+			r.ContentLength = int64(len(body))
+			r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+			r.Body, _ = r.GetBody()
+			if len(body) == 0 {
+				r.Body = http.NoBody
+			}
+			return next.RoundTrip(r)
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// ErrQuotaExceeded returned by DownloadQuota middleware for requests made after the quota exceeded
+var ErrQuotaExceeded = errors.New("download quota exceeded")
+
+// DownloadQuota middleware counts bytes of response bodies read through it and fails new requests
+// with ErrQuotaExceeded, without sending, once the total exceeded maxBytes. Bodies of responses already
+// returned can be read till the end. The quota shared by all requests made with the same requester.
+func DownloadQuota(maxBytes int64) RoundTripperHandler {
+	var total int64
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			if used := atomic.LoadInt64(&total); used > maxBytes {
+				return nil, fmt.Errorf("%w: %d bytes read, quota %d", ErrQuotaExceeded, used, maxBytes)
+			}
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.Body == nil || resp.Body == http.NoBody {
+				return resp, err
+			}
+			resp.Body = &countingBody{ReadCloser: resp.Body, total: &total}
+			return resp, nil
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// countingBody adds the number of bytes read to the total
+type countingBody struct {
+	io.ReadCloser
+	total *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.total, int64(n))
+	return n, err
+}
+
+// limitedBody fails with ErrRequestTooLarge if more than limit bytes read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("%w: limit %d", ErrRequestTooLarge, b.limit)
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1] // read one byte over the limit to detect the overflow
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n - 1, fmt.Errorf("%w: limit %d", ErrRequestTooLarge, b.limit)
+	}
+	return n, err
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestMaxRequestSize(t *testing.T) {
+	var bodies []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		if r.Body == nil || r.Body == http.NoBody {
+			return &http.Response{StatusCode: 200}, nil
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, string(body))
+		return &http.Response{StatusCode: 200}, nil
+	}}
+	h := MaxRequestSize(10)(rmock)
+
+	t.Run("known length rejected up front", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://example.com/blah", bytes.NewBufferString("12345678901"))
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRequestTooLarge), err)
+		assert.Equal(t, 0, rmock.Calls())
+	})
+
+	t.Run("within limit", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://example.com/blah", io.NopCloser(strings.NewReader("1234567890")))
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		req, err = http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1234567890"}, bodies)
+	})
+
+	t.Run("unknown length over limit", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://example.com/blah", io.NopCloser(strings.NewReader("12345678901")))
+		require.NoError(t, err)
+		_, err = h.RoundTrip(req)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRequestTooLarge), err)
+	})
+}
+
+func TestMaxRequestSize_Streamed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer ts.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for i := 0; i < 100; i++ {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+		}
+		_ = pw.Close()
+	}()
+
+	req, err := http.NewRequest("POST", ts.URL, pr)
+	require.NoError(t, err)
+	client := http.Client{Transport: MaxRequestSize(10 * 1024)(http.DefaultTransport)}
+	_, err = client.Do(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrRequestTooLarge), err)
+}
+
+func TestEnsureContentLength(t *testing.T) {
+	type received struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+	var got []received
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = append(got, received{r.ContentLength, r.TransferEncoding, string(body)})
+	}))
+	defer ts.Close()
+	h := EnsureContentLength(16)(http.DefaultTransport)
+
+	send := func(body io.Reader) {
+		req, err := http.NewRequest("POST", ts.URL, body)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	send(io.NopCloser(strings.NewReader("some body"))) // unknown length, chunked without the middleware
+	send(io.NopCloser(strings.NewReader("body over the 16 bytes limit")))
+	send(strings.NewReader("known"))
+	send(io.NopCloser(strings.NewReader("")))
+
+	require.Equal(t, 4, len(got))
+	assert.Equal(t, received{9, nil, "some body"}, got[0], "content length set, body intact")
+	assert.Equal(t, received{-1, []string{"chunked"}, "body over the 16 bytes limit"}, got[1], "over the limit sent chunked")
+	assert.Equal(t, received{5, nil, "known"}, got[2])
+	assert.Equal(t, received{0, nil, ""}, got[3])
+}
+
+func TestEnsureContentLength_ReadFailed(t *testing.T) {
+	body := &failingBody{}
+	req, err := http.NewRequest("POST", "http://example.com/blah", body)
+	require.NoError(t, err)
+	_, err = EnsureContentLength(16)(http.DefaultTransport).RoundTrip(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "read failed")
+	assert.True(t, body.closed, "request body closed")
+}
+
+// failingBody fails all reads and records Close call
+type failingBody struct {
+	closed bool
+}
+
+func (b *failingBody) Read([]byte) (int, error) { return 0, errors.New("read failed") }
+
+func (b *failingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDownloadQuota(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("0123456789"))}, nil
+	}}
+	quota := DownloadQuota(25)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := quota(rmock).RoundTrip(req) // chain made per request, like requester does
+		require.NoError(t, err, "request %d", i)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "0123456789", string(body))
+		require.NoError(t, resp.Body.Close())
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = quota(rmock).RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.EqualError(t, err, "download quota exceeded: 30 bytes read, quota 25")
+	assert.Equal(t, 3, rmock.Calls(), "request not sent")
+}
+
+func TestDownloadQuota_Concurrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(strings.Repeat("x", 100)))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	h := DownloadQuota(1000)(http.DefaultTransport)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+			require.NoError(t, err)
+			resp, err := h.RoundTrip(req)
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+		}()
+	}
+	wg.Wait()
+
+	// exactly at the quota, one more body crosses it
+	req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+	require.NoError(t, err)
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	req, err = http.NewRequest("GET", ts.URL, http.NoBody)
+	require.NoError(t, err)
+	_, err = h.RoundTrip(req)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// SLA middleware calls onViolation if the round trip took longer than threshold, i.e. to emit warnings.
+// Called for both successful and failed round trips, the request and the response are not affected.
+// The time measured till the response headers received, reading of the body is not included.
+func SLA(threshold time.Duration, onViolation func(req *http.Request, elapsed time.Duration)) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			st := time.Now()
+			resp, err := next.RoundTrip(req)
+			if elapsed := time.Since(st); elapsed > threshold {
+				onViolation(req, elapsed)
+			}
+			return resp, err
+		}
+		return RoundTripperFunc(fn)
+	}
+}
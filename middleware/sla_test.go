@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestSLA(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/slow-err":
+			time.Sleep(50 * time.Millisecond)
+			return nil, errors.New("failed")
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	var violations []string
+	var elapsed []time.Duration
+	h := SLA(20*time.Millisecond, func(req *http.Request, d time.Duration) {
+		violations = append(violations, req.URL.Path)
+		elapsed = append(elapsed, d)
+	})(rmock)
+
+	for _, p := range []string{"/fast", "/slow", "/slow-err"} {
+		req, err := http.NewRequest("GET", "http://example.com"+p, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		if p == "/slow-err" {
+			require.EqualError(t, err, "failed")
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	assert.Equal(t, []string{"/slow", "/slow-err"}, violations)
+	for _, d := range elapsed {
+		assert.True(t, d >= 50*time.Millisecond, d)
+	}
+	assert.Equal(t, 3, rmock.Calls())
+}
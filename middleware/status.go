@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// statusErrorBodyLimit caps the body snippet kept in StatusError
+const statusErrorBodyLimit = 1024
+
+// StatusError returned by EnsureStatus for responses with unacceptable status code.
+// Body contains up to 1024 bytes of the response body.
+type StatusError struct {
+	Code int
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("unexpected status %d", e.Code)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.Code, e.Body)
+}
+
+// EnsureStatus middleware turns responses with unacceptable status into *StatusError, the response body closed.
+// By default any status outside of 200-299 is unacceptable, codes set the list of acceptable ones instead.
+// Middlewares placed before EnsureStatus in the chain, i.e. Repeater, see the original response status.
+func EnsureStatus(codes ...int) RoundTripperHandler {
+	acceptable := func(code int) bool {
+		if len(codes) == 0 {
+			return code >= 200 && code < 300
+		}
+		for _, c := range codes {
+			if c == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil || acceptable(resp.StatusCode) {
+				return resp, err
+			}
+			serr := &StatusError{Code: resp.StatusCode}
+			if resp.Body != nil {
+				serr.Body, _ = io.ReadAll(io.LimitReader(resp.Body, statusErrorBodyLimit))
+				_ = resp.Body.Close()
+			}
+			return nil, serr
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// ErrUnexpectedContentType is the error matched by *ContentTypeError with errors.Is
+var ErrUnexpectedContentType = errors.New("unexpected content type")
+
+// ContentTypeError returned by ExpectContentType for responses with unexpected Content-Type.
+// Body contains up to 1024 bytes of the response body.
+type ContentTypeError struct {
+	ContentType string
+	Body        []byte
+}
+
+func (e *ContentTypeError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("%s %q", ErrUnexpectedContentType, e.ContentType)
+	}
+	return fmt.Sprintf("%s %q: %s", ErrUnexpectedContentType, e.ContentType, e.Body)
+}
+
+// Unwrap returns ErrUnexpectedContentType
+func (e *ContentTypeError) Unwrap() error { return ErrUnexpectedContentType }
+
+// ExpectContentType middleware turns 2xx responses with Content-Type not in types, parameters like charset ignored,
+// into *ContentTypeError, the response body closed. I.e. to fail early on html error page instead of expected json.
+// Responses with other statuses passed as-is.
+func ExpectContentType(types ...string) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				return resp, err
+			}
+			ct := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+			for _, t := range types {
+				if strings.EqualFold(t, ct) {
+					return resp, nil
+				}
+			}
+			cterr := &ContentTypeError{ContentType: ct}
+			if resp.Body != nil {
+				cterr.Body, _ = io.ReadAll(io.LimitReader(resp.Body, statusErrorBodyLimit))
+				_ = resp.Body.Close()
+			}
+			return nil, cterr
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+// ErrNoContent and ErrNotModified are the errors matched by *EmptyBodyError with errors.Is
+var (
+	ErrNoContent   = errors.New("no content")
+	ErrNotModified = errors.New("not modified")
+)
+
+// EmptyBodyError returned by EmptyBodyAsError for 204 and 304 responses. Response is the original response,
+// with the body closed.
+type EmptyBodyError struct {
+	Response *http.Response
+}
+
+func (e *EmptyBodyError) Error() string { return e.Unwrap().Error() }
+
+// Unwrap returns ErrNoContent for 204 response and ErrNotModified otherwise
+func (e *EmptyBodyError) Unwrap() error {
+	if e.Response.StatusCode == http.StatusNoContent {
+		return ErrNoContent
+	}
+	return ErrNotModified
+}
+
+// EmptyBodyAsError middleware turns 204 No Content and 304 Not Modified responses into *EmptyBodyError,
+// matching ErrNoContent and ErrNotModified with errors.Is, so callers can handle them without checking status codes.
+// The response is available with errors.As.
+func EmptyBodyAsError(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil || (resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified) {
+			return resp, err
+		}
+		if resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, &EmptyBodyError{Response: resp}
+	}
+	return RoundTripperFunc(fn)
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestEnsureStatus(t *testing.T) {
+	respBody := func(code int, body string) *mocks.RoundTripper {
+		return &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}}
+	}
+
+	t.Run("ok passed", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := EnsureStatus()(respBody(200, "something")).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "something", string(body))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = EnsureStatus()(respBody(404, "not found")).RoundTrip(req)
+		require.Error(t, err)
+		var serr *StatusError
+		require.True(t, errors.As(err, &serr))
+		assert.Equal(t, 404, serr.Code)
+		assert.Equal(t, "not found", string(serr.Body))
+		assert.Equal(t, "unexpected status 404: not found", err.Error())
+	})
+
+	t.Run("body truncated", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = EnsureStatus()(respBody(500, strings.Repeat("x", 2000))).RoundTrip(req)
+		var serr *StatusError
+		require.True(t, errors.As(err, &serr))
+		assert.Equal(t, 1024, len(serr.Body))
+	})
+
+	t.Run("custom codes", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := EnsureStatus(200, 404)(respBody(404, "")).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+
+		_, err = EnsureStatus(200, 404)(respBody(201, "")).RoundTrip(req)
+		var serr *StatusError
+		require.True(t, errors.As(err, &serr))
+		assert.Equal(t, 201, serr.Code)
+		assert.Equal(t, "unexpected status 201", err.Error())
+	})
+
+	t.Run("transport error", func(t *testing.T) {
+		rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return nil, errors.New("failed")
+		}}
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = EnsureStatus()(rmock).RoundTrip(req)
+		require.EqualError(t, err, "failed")
+	})
+}
+
+func TestExpectContentType(t *testing.T) {
+	respType := func(code int, contentType, body string) *mocks.RoundTripper {
+		return &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Header: http.Header{"Content-Type": {contentType}},
+				Body: io.NopCloser(strings.NewReader(body))}, nil
+		}}
+	}
+
+	t.Run("json passed", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := ExpectContentType("application/json")(respType(200, "application/json; charset=utf-8", `{"a":1}`)).RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"a":1}`, string(body))
+	})
+
+	t.Run("html rejected", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		_, err = ExpectContentType("application/json", "text/plain")(respType(200, "text/html", "<html>oops</html>")).RoundTrip(req)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrUnexpectedContentType))
+		var cterr *ContentTypeError
+		require.True(t, errors.As(err, &cterr))
+		assert.Equal(t, "text/html", cterr.ContentType)
+		assert.Equal(t, "<html>oops</html>", string(cterr.Body))
+		assert.Equal(t, `unexpected content type "text/html": <html>oops</html>`, err.Error())
+	})
+
+	t.Run("non 2xx passed", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := ExpectContentType("application/json")(respType(502, "text/html", "bad gateway")).RoundTrip(req)
+		require.NoError(t, err)
+		assert.Equal(t, 502, resp.StatusCode)
+	})
+}
+
+func TestEmptyBodyAsError(t *testing.T) {
+	respCode := func(code int) *mocks.RoundTripper {
+		return &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Header: http.Header{"Etag": {"abc"}}, Body: http.NoBody}, nil
+		}}
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+
+	_, err = EmptyBodyAsError(respCode(204)).RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNoContent))
+	assert.False(t, errors.Is(err, ErrNotModified))
+	assert.EqualError(t, err, "no content")
+	var eberr *EmptyBodyError
+	require.True(t, errors.As(err, &eberr))
+	assert.Equal(t, 204, eberr.Response.StatusCode, "response retrievable")
+
+	_, err = EmptyBodyAsError(respCode(304)).RoundTrip(req)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNotModified))
+	require.True(t, errors.As(err, &eberr))
+	assert.Equal(t, "abc", eberr.Response.Header.Get("Etag"))
+
+	resp, err := EmptyBodyAsError(respCode(200)).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
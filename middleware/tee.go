@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// TeeResponse middleware passes a copy of each successful response body to the sink, i.e. for auditing.
+// The body is read in memory and replaced with a fresh reader, so the caller still reads it.
+func TeeResponse(sink func(req *http.Request, body []byte)) RoundTripperHandler {
+	return TeeResponseLimit(0, sink)
+}
+
+// TeeResponseLimit is the same as TeeResponse but buffers up to limit bytes of the body and passes the truncated copy
+// to the sink. The rest of the body streamed to the caller as-is. Zero limit means no limit.
+func TeeResponseLimit(limit int64, sink func(req *http.Request, body []byte)) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.Body == nil {
+				return resp, err
+			}
+
+			var r io.Reader = resp.Body
+			if limit > 0 {
+				r = io.LimitReader(resp.Body, limit)
+			}
+			body, err := io.ReadAll(r)
+			if err != nil {
+				_ = resp.Body.Close()
+				return nil, fmt.Errorf("tee response body: %w", err)
+			}
+			sink(req, append([]byte(nil), body...))
+
+			if limit > 0 { // the rest of the body not read yet
+				resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+				return resp, nil
+			}
+			_ = resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp, nil
+		}
+		return RoundTripperFunc(fn)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestTeeResponse(t *testing.T) {
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(bytes.NewBufferString("response body"))}, nil
+	}}
+
+	t.Run("full body", func(t *testing.T) {
+		var audit []string
+		h := TeeResponse(func(req *http.Request, body []byte) {
+			audit = append(audit, req.URL.Path+" "+string(body))
+		})
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+
+		resp, err := h(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "response body", string(body))
+		assert.Equal(t, []string{"/blah response body"}, audit)
+	})
+
+	t.Run("limited", func(t *testing.T) {
+		var audit []string
+		h := TeeResponseLimit(8, func(req *http.Request, body []byte) {
+			audit = append(audit, string(body))
+		})
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+
+		resp, err := h(rmock).RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "response body", string(body), "caller reads the full body")
+		assert.Equal(t, []string{"response"}, audit, "sink gets truncated copy")
+		require.NoError(t, resp.Body.Close())
+	})
+}
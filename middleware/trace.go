@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptrace"
+)
+
+// ClientTrace middleware attaches httptrace.ClientTrace made by factory to each request's context, so DNS, connect,
+// TLS and first byte events can be hooked. The factory called per request, nil trace skips the request.
+// Hooks of the trace already set in the context called too.
+func ClientTrace(factory func(req *http.Request) *httptrace.ClientTrace) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			trace := factory(req)
+			if trace == nil {
+				return next.RoundTrip(req)
+			}
+			return next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		}
+		return RoundTripperFunc(fn)
+	}
+}
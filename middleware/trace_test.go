@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTrace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("something"))
+	}))
+	defer ts.Close()
+
+	var lock sync.Mutex
+	events := map[string][]string{}
+	record := func(path, event string) {
+		lock.Lock()
+		events[path] = append(events[path], event)
+		lock.Unlock()
+	}
+	h := ClientTrace(func(req *http.Request) *httptrace.ClientTrace {
+		if req.URL.Path == "/skip" {
+			return nil
+		}
+		path := req.URL.Path
+		return &httptrace.ClientTrace{
+			ConnectStart:         func(network, addr string) { record(path, "connect start") },
+			GotFirstResponseByte: func() { record(path, "first byte") },
+		}
+	})(&http.Transport{})
+
+	for _, p := range []string{"/first", "/skip"} {
+		req, err := http.NewRequest("GET", ts.URL+p, http.NoBody)
+		require.NoError(t, err)
+		resp, err := h.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, map[string][]string{"/first": {"connect start", "first byte"}}, events,
+		"hooks fired for traced request only")
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// TTFB middleware reports time to the first byte of the response to obs, separately from the body read time.
+// Measured with httptrace GotFirstResponseByte hook, combined with the trace already set in the request context.
+// For transports not supporting httptrace the time till the round trip returned, i.e. headers received, reported.
+// Not called for failed round trips.
+func TTFB(obs func(req *http.Request, ttfb time.Duration)) RoundTripperHandler {
+	return func(next http.RoundTripper) http.RoundTripper {
+		fn := func(req *http.Request) (*http.Response, error) {
+			var once sync.Once
+			var ttfb time.Duration
+			st := time.Now()
+			trace := &httptrace.ClientTrace{
+				GotFirstResponseByte: func() {
+					once.Do(func() { ttfb = time.Since(st) })
+				},
+			}
+			resp, err := next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+			if err != nil {
+				return resp, err
+			}
+			once.Do(func() { ttfb = time.Since(st) }) // no first byte event, i.e. not a net/http transport
+			obs(req, ttfb)
+			return resp, nil
+		}
+		return RoundTripperFunc(fn)
+	}
+}
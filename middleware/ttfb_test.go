@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-pkgz/requester/middleware/mocks"
+)
+
+func TestTTFB(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first part "))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond) // slow body
+		_, _ = w.Write([]byte("second part"))
+	}))
+	defer ts.Close()
+
+	var ttfbs []time.Duration
+	h := TTFB(func(req *http.Request, ttfb time.Duration) {
+		ttfbs = append(ttfbs, ttfb)
+	})(http.DefaultTransport)
+
+	st := time.Now()
+	req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+	require.NoError(t, err)
+	resp, err := h.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	total := time.Since(st)
+
+	assert.Equal(t, "first part second part", string(body))
+	require.Equal(t, 1, len(ttfbs))
+	assert.True(t, ttfbs[0] > 0, ttfbs[0])
+	assert.True(t, ttfbs[0] < 100*time.Millisecond, "ttfb %v excludes slow body", ttfbs[0])
+	assert.True(t, total >= 100*time.Millisecond, total)
+
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		time.Sleep(10 * time.Millisecond)
+		return &http.Response{StatusCode: 201}, nil
+	}}
+	ttfbs = nil
+	_, err = TTFB(func(req *http.Request, ttfb time.Duration) { ttfbs = append(ttfbs, ttfb) })(rmock).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ttfbs))
+	assert.True(t, ttfbs[0] >= 10*time.Millisecond, "round trip time for transport without httptrace")
+}
@@ -0,0 +1,234 @@
+// Package vcr implements middleware recording requests with responses to a cassette file and replaying them,
+// for deterministic tests without a live server.
+package vcr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-pkgz/requester/middleware"
+)
+
+// Mode defines if the Recorder records or replays interactions
+type Mode int
+
+// enum of Mode
+const (
+	Record Mode = iota // make real requests and keep them with responses
+	Replay             // serve responses from the cassette, no real requests made
+)
+
+// redacted replaces values of sensitive headers in the cassette
+const redacted = "REDACTED"
+
+// ErrNoMatch returned in Replay mode for requests not found in the cassette
+var ErrNoMatch = errors.New("no recorded interaction")
+
+// Recorder is the middleware recording or replaying request/response pairs.
+// Requests matched by method, url and body, optionally by headers. Values of credential headers,
+// Authorization, Proxy-Authorization, Cookie and Set-Cookie by default, are redacted in the cassette.
+type Recorder struct {
+	path         string
+	mode         Mode
+	ignoreBody   bool
+	matchHeaders []string
+	redact       []string
+
+	lock         sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// Interaction is a recorded pair of request and response
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded request
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is a recorded response
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// New makes Recorder for the cassette file. In Replay mode the cassette loaded from the file.
+func New(path string, mode Mode, opts ...func(r *Recorder)) (*Recorder, error) {
+	res := Recorder{path: path, mode: mode,
+		redact: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}}
+	for _, opt := range opts {
+		opt(&res)
+	}
+	if mode != Replay {
+		return &res, nil
+	}
+
+	data, err := os.ReadFile(path) // nolint gosec
+	if err != nil {
+		return nil, fmt.Errorf("read cassette: %w", err)
+	}
+	if err = json.Unmarshal(data, &res.interactions); err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", path, err)
+	}
+	res.used = make([]bool, len(res.interactions))
+	return &res, nil
+}
+
+// IgnoreBody makes requests matched without body
+func IgnoreBody(r *Recorder) {
+	r.ignoreBody = true
+}
+
+// MatchHeaders makes listed headers a part of request matching
+func MatchHeaders(headers ...string) func(r *Recorder) {
+	return func(r *Recorder) {
+		r.matchHeaders = append([]string{}, headers...)
+	}
+}
+
+// RedactHeaders sets headers with values replaced by "REDACTED" in the cassette, replacing the default list.
+// Redacted headers still matched by MatchHeaders, by presence only.
+func RedactHeaders(headers ...string) func(r *Recorder) {
+	return func(r *Recorder) {
+		r.redact = append([]string{}, headers...)
+	}
+}
+
+// Middleware records requests with responses or replays them, depending on mode
+func (r *Recorder) Middleware(next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		body, err := readBody(req)
+		if err != nil {
+			return nil, fmt.Errorf("vcr: read request body: %w", err)
+		}
+		recReq := Request{Method: req.Method, URL: req.URL.String(), Header: r.redacted(req.Header), Body: body}
+
+		if r.mode == Replay {
+			return r.replay(req, recReq)
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		recResp := Response{StatusCode: resp.StatusCode, Status: resp.Status, Header: r.redacted(resp.Header)}
+		if resp.Body != nil {
+			if recResp.Body, err = io.ReadAll(resp.Body); err != nil {
+				_ = resp.Body.Close()
+				return nil, fmt.Errorf("vcr: read response body: %w", err)
+			}
+			_ = resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(recResp.Body))
+		}
+
+		r.lock.Lock()
+		r.interactions = append(r.interactions, Interaction{Request: recReq, Response: recResp})
+		r.lock.Unlock()
+		return resp, nil
+	}
+	return middleware.RoundTripperFunc(fn)
+}
+
+// Save writes recorded interactions to the cassette file
+func (r *Recorder) Save() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	data, err := json.MarshalIndent(r.interactions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal cassette: %w", err)
+	}
+	if err = os.WriteFile(r.path, data, 0o600); err != nil {
+		return fmt.Errorf("write cassette: %w", err)
+	}
+	return nil
+}
+
+// replay returns response of the first not used matching interaction, the last matching one if all used
+func (r *Recorder) replay(req *http.Request, recReq Request) (*http.Response, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	found := -1
+	for i, it := range r.interactions {
+		if !r.match(it.Request, recReq) {
+			continue
+		}
+		found = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("vcr: %w for %s %s", ErrNoMatch, recReq.Method, recReq.URL)
+	}
+	r.used[found] = true
+
+	rec := r.interactions[found].Response
+	return &http.Response{
+		StatusCode:    rec.StatusCode,
+		Status:        rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (r *Recorder) match(recorded, req Request) bool {
+	if recorded.Method != req.Method || recorded.URL != req.URL {
+		return false
+	}
+	if !r.ignoreBody && !bytes.Equal(recorded.Body, req.Body) {
+		return false
+	}
+	for _, h := range r.matchHeaders {
+		if strings.Join(recorded.Header.Values(h), ",") != strings.Join(req.Header.Values(h), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// redacted returns a copy of headers with values of redacted ones replaced
+func (r *Recorder) redacted(h http.Header) http.Header {
+	res := h.Clone()
+	for _, name := range r.redact {
+		if vv := res.Values(name); len(vv) > 0 {
+			res.Set(name, redacted)
+		}
+	}
+	return res
+}
+
+// readBody reads the request body and replaces it with in-memory copy
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
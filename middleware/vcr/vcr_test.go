@@ -0,0 +1,197 @@
+package vcr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder_RecordReplay(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&count, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "blah")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, "%s %s %s #%d", r.Method, r.URL.Path, body, n)
+	}))
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	rec, err := New(cassette, Record)
+	require.NoError(t, err)
+	client := http.Client{Transport: rec.Middleware(http.DefaultTransport)}
+
+	do := func(client http.Client, method, path, body string) (*http.Response, string, error) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(respBody), nil
+	}
+
+	_, body, err := do(client, "GET", "/one", "")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /one  #1", body)
+	_, body, err = do(client, "POST", "/two", "b1")
+	require.NoError(t, err)
+	assert.Equal(t, "POST /two b1 #2", body)
+	_, body, err = do(client, "POST", "/two", "b2")
+	require.NoError(t, err)
+	assert.Equal(t, "POST /two b2 #3", body)
+	require.NoError(t, rec.Save())
+	ts.Close()
+
+	rep, err := New(cassette, Replay)
+	require.NoError(t, err)
+	client = http.Client{Transport: rep.Middleware(http.DefaultTransport)}
+
+	resp, body, err := do(client, "POST", "/two", "b2")
+	require.NoError(t, err)
+	assert.Equal(t, "POST /two b2 #3", body)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "blah", resp.Header.Get("X-Test"))
+
+	_, body, err = do(client, "GET", "/one", "")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /one  #1", body)
+
+	_, _, err = do(client, "POST", "/two", "b3")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNoMatch), err)
+	_, _, err = do(client, "GET", "/three", "")
+	assert.True(t, errors.Is(err, ErrNoMatch), err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count), "no requests made in replay mode")
+}
+
+func TestRecorder_Matching(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("user " + r.Header.Get("X-User")))
+	}))
+	defer ts.Close()
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+
+	rec, err := New(cassette, Record)
+	require.NoError(t, err)
+	for _, user := range []string{"u1", "u2"} {
+		req, e := http.NewRequest("POST", ts.URL, bytes.NewBufferString("body-"+user))
+		require.NoError(t, e)
+		req.Header.Set("X-User", user)
+		resp, e := rec.Middleware(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, e)
+		_ = resp.Body.Close()
+	}
+	require.NoError(t, rec.Save())
+
+	replay := func(r *Recorder, user, body string) (string, error) {
+		req, e := http.NewRequest("POST", ts.URL, bytes.NewBufferString(body))
+		require.NoError(t, e)
+		req.Header.Set("X-User", user)
+		resp, e := r.Middleware(http.DefaultTransport).RoundTrip(req)
+		if e != nil {
+			return "", e
+		}
+		defer resp.Body.Close()
+		b, e := io.ReadAll(resp.Body)
+		require.NoError(t, e)
+		return string(b), nil
+	}
+
+	t.Run("ignore body, match header", func(t *testing.T) {
+		rep, err := New(cassette, Replay, IgnoreBody, MatchHeaders("X-User"))
+		require.NoError(t, err)
+		res, err := replay(rep, "u2", "something else")
+		require.NoError(t, err)
+		assert.Equal(t, "user u2", res)
+		_, err = replay(rep, "u3", "body-u1")
+		assert.True(t, errors.Is(err, ErrNoMatch), err)
+	})
+
+	t.Run("ignore body, repeated requests", func(t *testing.T) {
+		rep, err := New(cassette, Replay, IgnoreBody)
+		require.NoError(t, err)
+		var res []string
+		for i := 0; i < 3; i++ {
+			r, err := replay(rep, "u3", "")
+			require.NoError(t, err)
+			res = append(res, r)
+		}
+		assert.Equal(t, []string{"user u1", "user u2", "user u2"}, res)
+	})
+
+	t.Run("match body", func(t *testing.T) {
+		rep, err := New(cassette, Replay)
+		require.NoError(t, err)
+		res, err := replay(rep, "u3", "body-u1")
+		require.NoError(t, err)
+		assert.Equal(t, "user u1", res)
+	})
+}
+
+func TestRecorder_RedactHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = w.Write([]byte("auth " + r.Header.Get("Authorization")))
+	}))
+	defer ts.Close()
+
+	record := func(opts ...func(r *Recorder)) string {
+		cassette := filepath.Join(t.TempDir(), "cassette.json")
+		rec, err := New(cassette, Record, opts...)
+		require.NoError(t, err)
+		req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		req.Header.Set("X-Api-Key", "secret-key")
+		resp, err := rec.Middleware(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "auth Bearer secret-token", string(body), "request sent as-is")
+		assert.Equal(t, "session=secret", resp.Header.Get("Set-Cookie"), "response returned as-is")
+		assert.Equal(t, "Bearer secret-token", req.Header.Get("Authorization"), "request not changed")
+		require.NoError(t, rec.Save())
+
+		data, err := os.ReadFile(cassette) // nolint gosec
+		require.NoError(t, err)
+		var interactions []Interaction
+		require.NoError(t, json.Unmarshal(data, &interactions))
+		require.Equal(t, 1, len(interactions))
+		assert.Equal(t, "REDACTED", interactions[0].Request.Header.Get("Authorization"))
+		return string(data)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		cassette := record()
+		assert.NotContains(t, cassette, "secret-token")
+		assert.NotContains(t, cassette, "session=secret")
+		assert.Contains(t, cassette, "secret-key")
+	})
+
+	t.Run("custom list", func(t *testing.T) {
+		cassette := record(RedactHeaders("Authorization", "X-Api-Key"))
+		assert.NotContains(t, cassette, "secret-token")
+		assert.NotContains(t, cassette, "secret-key")
+		assert.Contains(t, cassette, "session=secret")
+	})
+}
+
+func TestRecorder_NoCassette(t *testing.T) {
+	_, err := New(filepath.Join(t.TempDir(), "not-found.json"), Replay)
+	require.Error(t, err)
+}
@@ -5,7 +5,19 @@
 package requester
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-pkgz/requester/middleware"
 )
@@ -14,6 +26,8 @@ import (
 type Requester struct {
 	client      http.Client
 	middlewares []middleware.RoundTripperHandler
+	baseURL     *url.URL
+	baseCtx     context.Context
 }
 
 // New creates requester with defaults
@@ -24,6 +38,55 @@ func New(client http.Client, middlewares ...middleware.RoundTripperHandler) *Req
 	}
 }
 
+// Option defines optional parameters of NewWithOptions
+type Option func(r *Requester)
+
+// NewWithOptions creates requester configured by options, with the default http.Client if no options set
+func NewWithOptions(opts ...Option) *Requester {
+	res := &Requester{}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// WithTimeout sets the timeout of the client, zero means no timeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Requester) {
+		r.client.Timeout = timeout
+	}
+}
+
+// WithBaseTransport sets the transport used as the base of the middlewares chain, http.DefaultTransport if not set
+func WithBaseTransport(tr http.RoundTripper) Option {
+	return func(r *Requester) {
+		r.client.Transport = tr
+	}
+}
+
+// WithMiddleware adds middleware(s) to the chain, in the same order as passed to New
+func WithMiddleware(middlewares ...middleware.RoundTripperHandler) Option {
+	return func(r *Requester) {
+		r.middlewares = append(r.middlewares, middlewares...)
+	}
+}
+
+// WithBaseURL sets the base url for requests with relative urls, resolved per RFC 3986, i.e. base "http://example.com/v1/"
+// and request "users" make "http://example.com/v1/users". Absolute urls used as-is. Resolved before all middlewares.
+func WithBaseURL(base *url.URL) Option {
+	return func(r *Requester) {
+		r.baseURL = base
+	}
+}
+
+// WithBaseContext sets the context all requests inherit cancellation from, in addition to their own contexts,
+// i.e. to cancel all in-flight requests on shutdown of the service owning the requester
+func WithBaseContext(ctx context.Context) Option {
+	return func(r *Requester) {
+		r.baseCtx = ctx
+	}
+}
+
 // Use adds middleware(s) to the requester chain
 func (r *Requester) Use(middlewares ...middleware.RoundTripperHandler) {
 	r.middlewares = append(r.middlewares, middlewares...)
@@ -33,24 +96,295 @@ func (r *Requester) Use(middlewares ...middleware.RoundTripperHandler) {
 func (r *Requester) With(middlewares ...middleware.RoundTripperHandler) *Requester {
 	res := &Requester{
 		client:      r.client,
-		middlewares: append(r.middlewares, middlewares...),
+		middlewares: append(append([]middleware.RoundTripperHandler{}, r.middlewares...), middlewares...),
+		baseURL:     r.baseURL,
+		baseCtx:     r.baseCtx,
+	}
+	return res
+}
+
+// WithClient makes a new Requester with inherited middlewares and the client, i.e. with a different timeout
+func (r *Requester) WithClient(client http.Client) *Requester {
+	return &Requester{
+		client:      client,
+		middlewares: append([]middleware.RoundTripperHandler{}, r.middlewares...),
+		baseURL:     r.baseURL,
+		baseCtx:     r.baseCtx,
+	}
+}
+
+// WithTransport makes a new Requester with inherited middlewares and the transport used as the base of the chain,
+// i.e. *http.Transport with TLSClientConfig enforcing minimal TLS version or pinning certificates.
+func (r *Requester) WithTransport(tr http.RoundTripper) *Requester {
+	res := &Requester{
+		client:      r.client,
+		middlewares: append([]middleware.RoundTripperHandler{}, r.middlewares...),
+		baseURL:     r.baseURL,
+		baseCtx:     r.baseCtx,
 	}
+	res.client.Transport = tr
 	return res
 }
 
+// WithTransportOptions makes a new Requester with inherited middlewares and the base transport tuned by fn,
+// i.e. to set ForceAttemptHTTP2 or MaxIdleConnsPerHost. The transport cloned from the client's *http.Transport
+// if set, from http.DefaultTransport if the client has no transport. A custom http.RoundTripper of the client
+// can't be tuned, it kept as-is and fn not called.
+func (r *Requester) WithTransportOptions(fn func(tr *http.Transport)) *Requester {
+	rt := r.client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	tr, ok := rt.(*http.Transport)
+	if !ok {
+		return r.WithTransport(r.client.Transport)
+	}
+	tr = tr.Clone()
+	fn(tr)
+	return r.WithTransport(tr)
+}
+
 // Client returns http.Client with all middlewares injected
 func (r *Requester) Client() *http.Client {
 	cl := r.client
-	if cl.Transport == nil {
-		cl.Transport = http.DefaultTransport
+	cl.Transport = r.RoundTripper()
+	return &cl
+}
+
+// RoundTripper returns the chain of all middlewares composed over the client's transport.
+// http.DefaultTransport used as the base if the client has no transport set.
+func (r *Requester) RoundTripper() http.RoundTripper {
+	rt := r.client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
 	}
 	for _, handler := range r.middlewares {
-		cl.Transport = handler(cl.Transport)
+		rt = handler(rt)
 	}
-	return &cl
+	if r.baseURL != nil {
+		rt = resolveBaseURL(r.baseURL, rt)
+	}
+	if r.baseCtx != nil {
+		rt = middleware.BaseContext(r.baseCtx)(rt)
+	}
+	return rt
+}
+
+// resolveBaseURL makes relative request urls absolute, against the base url
+func resolveBaseURL(base *url.URL, next http.RoundTripper) http.RoundTripper {
+	fn := func(req *http.Request) (*http.Response, error) {
+		if req.URL.IsAbs() {
+			return next.RoundTrip(req)
+		}
+		r := req.WithContext(req.Context())
+		r.URL = base.ResolveReference(req.URL)
+		return next.RoundTrip(r)
+	}
+	return middleware.RoundTripperFunc(fn)
+}
+
+// BatchResult is the result of a single request made by DoBatch
+type BatchResult struct {
+	Index int // index of the request in the batch
+	Resp  *http.Response
+	Err   error
+}
+
+// DoBatch makes requests through all middlewares, up to parallelism at a time, and returns results in the order of reqs.
+// Zero parallelism means all requests at once. Requests not started before ctx canceled fail with ctx error,
+// started ones aborted, in addition to their own contexts. The caller should close bodies of the returned responses,
+// reading of the bodies aborted by ctx cancellation too.
+func (r *Requester) DoBatch(ctx context.Context, reqs []*http.Request, parallelism int) []BatchResult {
+	if parallelism <= 0 {
+		parallelism = len(reqs)
+	}
+	client := r.With(middleware.BaseContext(ctx)).Client()
+	res := make([]BatchResult, len(reqs))
+	sema := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, req := range reqs {
+		res[i].Index = i
+		select {
+		case sema <- struct{}{}:
+		case <-ctx.Done():
+			res[i].Err = ctx.Err()
+			continue
+		}
+		if err := ctx.Err(); err != nil { // both cases may be ready, cancellation takes priority
+			<-sema
+			res[i].Err = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, req *http.Request) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+			res[i].Resp, res[i].Err = client.Do(req)
+		}(i, req)
+	}
+	wg.Wait()
+	return res
+}
+
+// warmupConcurrency limits the number of parallel warmup requests
+const warmupConcurrency = 8
+
+// Warmup makes HEAD requests to urls through all middlewares, so connections established and pooled by the transport
+// before the real traffic. Requests made in parallel, the error reports all failed urls. Response status is ignored.
+func (r *Requester) Warmup(ctx context.Context, urls ...string) error {
+	client := r.Client()
+	sema := make(chan struct{}, warmupConcurrency)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []string
+
+	for _, u := range urls {
+		wg.Add(1)
+		sema <- struct{}{}
+		go func(u string) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+			err := func() error {
+				req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, http.NoBody)
+				if err != nil {
+					return err
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return err
+				}
+				return resp.Body.Close()
+			}()
+			if err != nil {
+				lock.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", u, err))
+				lock.Unlock()
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("warmup failed for %d of %d urls: %s", len(errs), len(urls), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// MiddlewareNames returns names of the installed middlewares in order of application, the first one is the innermost,
+// i.e. "middleware.Header" or "logger.Middleware". Names derived from functions, anonymous middlewares named as the
+// function they defined in, i.e. "main.main".
+func (r *Requester) MiddlewareNames() []string {
+	res := make([]string, 0, len(r.middlewares))
+	for _, handler := range r.middlewares {
+		res = append(res, handlerName(handler))
+	}
+	return res
+}
+
+var closureSuffix = regexp.MustCompile(`(\.func\d+)+(\.\d+)*$`)
+
+// handlerName makes short name of the handler's function, without package path and closure suffixes.
+// Method values named by the receiver type, i.e. "cache.Middleware" for (*cache.Middleware).Middleware.
+func handlerName(handler middleware.RoundTripperHandler) string {
+	if handler == nil {
+		return "nil"
+	}
+	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	if strings.HasSuffix(name, "-fm") { // method value, keep the receiver type only
+		name = strings.TrimSuffix(name, "-fm")
+		name = name[:strings.LastIndex(name, ".")]
+		name = strings.NewReplacer("(*", "", ")", "").Replace(name)
+		return name
+	}
+	return closureSuffix.ReplaceAllString(name, "")
 }
 
 // Do runs http request with optional middleware handlers wrapping the request
 func (r *Requester) Do(req *http.Request) (*http.Response, error) {
 	return r.Client().Do(req)
 }
+
+// DoCtx runs http request with ctx applied, for requests made without a context. The context set on the request
+// already (anything but context.Background and context.TODO) takes precedence, to replace it use req.WithContext.
+func (r *Requester) DoCtx(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if rc := req.Context(); rc == context.Background() || rc == context.TODO() {
+		req = req.WithContext(ctx)
+	}
+	return r.Do(req)
+}
+
+// PostJSON marshals payload to JSON and sends it as POST request with application/json content type.
+// The request body can be replayed with GetBody, i.e. by Repeater. Marshaling error returned without sending.
+func (r *Requester) PostJSON(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("make request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return r.Do(req)
+}
+
+// WithRequestContext returns a shallow copy of req with the context derived from req's context, limited by timeout
+// and carrying values, i.e. for context-reading middlewares. Zero timeout means no additional deadline.
+// The returned cancel releases the derived context and should be called as soon as the response is read.
+func WithRequestContext(req *http.Request, timeout time.Duration, values map[interface{}]interface{}) (*http.Request, context.CancelFunc) {
+	ctx := req.Context()
+	for k, v := range values {
+		ctx = context.WithValue(ctx, k, v) // nolint staticcheck // keys provided by the caller
+	}
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return req.WithContext(ctx), cancel
+}
+
+var defaultRequester = struct {
+	sync.RWMutex
+	r *Requester
+}{r: New(http.Client{})}
+
+// SetDefault sets the Requester used by package-level Do and Get, like http.DefaultClient for http.Get.
+// Nil resets it to the initial one, with the default http.Client and no middlewares. Safe for concurrent use.
+func SetDefault(r *Requester) {
+	if r == nil {
+		r = New(http.Client{})
+	}
+	defaultRequester.Lock()
+	defaultRequester.r = r
+	defaultRequester.Unlock()
+}
+
+// Default returns the Requester used by package-level Do and Get
+func Default() *Requester {
+	defaultRequester.RLock()
+	defer defaultRequester.RUnlock()
+	return defaultRequester.r
+}
+
+// Do runs http request with the default Requester, set by SetDefault
+func Do(req *http.Request) (*http.Response, error) {
+	return Default().Do(req)
+}
+
+// Get makes GET request to url with the default Requester, set by SetDefault
+func Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("make request: %w", err)
+	}
+	return Default().Do(req)
+}
@@ -2,12 +2,17 @@ package requester
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -17,6 +22,7 @@ import (
 
 	"github.com/go-pkgz/requester/middleware"
 	"github.com/go-pkgz/requester/middleware/logger"
+	"github.com/go-pkgz/requester/middleware/mocks"
 )
 
 func TestRequester_DoSimpleMiddleware(t *testing.T) {
@@ -238,6 +244,665 @@ func TestRequester_DoNotReplaceTransport(t *testing.T) {
 	assert.Greater(t, atomic.LoadInt32(&caughtReq), int32(1))
 }
 
+func TestRequester_RoundTripper(t *testing.T) {
+	var calls []string
+	mw := func(name string) middleware.RoundTripperHandler {
+		return func(next http.RoundTripper) http.RoundTripper {
+			fn := func(r *http.Request) (*http.Response, error) {
+				calls = append(calls, name)
+				return next.RoundTrip(r)
+			}
+			return middleware.RoundTripperFunc(fn)
+		}
+	}
+
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		calls = append(calls, "transport")
+		return &http.Response{StatusCode: 201}, nil
+	}}
+
+	rq := New(http.Client{Transport: rmock}, mw("mw1"), mw("mw2"))
+	rt := rq.RoundTripper()
+	assert.Equal(t, rmock, rq.client.Transport, "client's transport not modified")
+
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, []string{"mw2", "mw1", "transport"}, calls, "the last middleware is the outermost")
+	assert.Equal(t, 1, rmock.Calls())
+}
+
+func TestRequester_WithTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "blah", r.Header.Get("test"))
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.MinVersion = tls.VersionTLS12
+	var calls int32
+	base := middleware.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return tr.RoundTrip(r)
+	})
+
+	rq := New(http.Client{Timeout: time.Second}, middleware.Header("test", "blah"))
+	rqTLS := rq.WithTransport(base)
+	assert.Nil(t, rq.client.Transport, "original requester not modified")
+
+	req, err := http.NewRequest("GET", ts.URL, http.NoBody)
+	require.NoError(t, err)
+	resp, err := rqTLS.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "configured transport made the round trip")
+
+	req, err = http.NewRequest("GET", ts.URL, http.NoBody)
+	require.NoError(t, err)
+	_, err = rq.Do(req)
+	require.Error(t, err, "default transport doesn't trust test certificate")
+}
+
+func TestRequester_CustomBaseTransport(t *testing.T) {
+	var calls []string
+	mw := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			calls = append(calls, "mw")
+			return next.RoundTrip(r)
+		}
+		return middleware.RoundTripperFunc(fn)
+	}
+	base := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		calls = append(calls, "base")
+		return &http.Response{StatusCode: 201, Body: http.NoBody}, nil
+	}}
+	rq := New(http.Client{Transport: base}, mw)
+
+	t.Run("do", func(t *testing.T) {
+		calls = nil
+		req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+		require.NoError(t, err)
+		resp, err := rq.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, []string{"mw", "base"}, calls)
+		assert.Equal(t, base, rq.client.Transport, "client's transport preserved")
+	})
+
+	t.Run("client", func(t *testing.T) {
+		calls = nil
+		resp, err := rq.Client().Get("http://example.com/blah")
+		require.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, []string{"mw", "base"}, calls)
+		assert.Equal(t, base, rq.client.Transport, "client's transport preserved")
+	})
+
+	t.Run("default transport", func(t *testing.T) {
+		rq := New(http.Client{}, mw)
+		_ = rq.Client()
+		assert.Nil(t, rq.client.Transport, "default transport not stored in the requester")
+	})
+}
+
+func TestRequester_PostJSON(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var p payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		assert.Equal(t, payload{Name: "blah", Count: 42}, p)
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	var calls int32
+	mw := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			assert.NotNil(t, r.GetBody, "body can be replayed")
+			return next.RoundTrip(r)
+		}
+		return middleware.RoundTripperFunc(fn)
+	}
+	rq := New(http.Client{Timeout: time.Second}, mw)
+
+	resp, err := rq.PostJSON(context.Background(), ts.URL, payload{Name: "blah", Count: 42})
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	_, err = rq.PostJSON(context.Background(), ts.URL, make(chan int))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "marshal payload")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "no request made")
+}
+
+func TestRequester_WithTransportOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	rq := New(http.Client{Timeout: time.Second}, middleware.Header("test", "blah"))
+	rqTuned := rq.WithTransportOptions(func(tr *http.Transport) {
+		tr.ForceAttemptHTTP2 = true
+		tr.MaxIdleConnsPerHost = 42
+	})
+	assert.Nil(t, rq.client.Transport, "original requester not modified")
+
+	tr, ok := rqTuned.client.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.Equal(t, 42, tr.MaxIdleConnsPerHost)
+	assert.True(t, tr.ForceAttemptHTTP2)
+	assert.NotEqual(t, 42, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost, "default transport not modified")
+
+	rqTuned2 := rqTuned.WithTransportOptions(func(tr *http.Transport) { tr.MaxIdleConns = 7 })
+	tr2 := rqTuned2.client.Transport.(*http.Transport)
+	assert.Equal(t, 42, tr2.MaxIdleConnsPerHost, "inherited from the client's transport")
+	assert.Equal(t, 7, tr2.MaxIdleConns)
+	assert.NotEqual(t, 7, tr.MaxIdleConns, "parent's transport not modified")
+
+	resp, err := rqTuned.Client().Get(ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	custom := middleware.RoundTripperFunc(http.DefaultTransport.RoundTrip)
+	called := false
+	rqCustom := rq.WithTransport(custom).WithTransportOptions(func(tr *http.Transport) { called = true })
+	assert.False(t, called, "custom transport can't be tuned")
+	resp, err = rqCustom.Client().Get(ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "custom transport kept")
+	assert.NotNil(t, rqCustom.client.Transport)
+	_, isTransport := rqCustom.client.Transport.(*http.Transport)
+	assert.False(t, isTransport, "not replaced by the default transport")
+}
+
+func TestRequester_MiddlewareNames(t *testing.T) {
+	var calls []string
+	mw := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			calls = append(calls, "custom")
+			return next.RoundTrip(r)
+		}
+		return middleware.RoundTripperFunc(fn)
+	}
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		calls = append(calls, "transport")
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}}
+	lg := logger.New(logger.Func(func(format string, args ...interface{}) { calls = append(calls, "logger") }))
+
+	rq := New(http.Client{Transport: rmock}, middleware.Header("k", "v"), lg.Middleware)
+	rq.Use(middleware.MaxConcurrent(2), mw)
+	rq2 := rq.With(middleware.JSON)
+
+	assert.Equal(t, []string{"middleware.Header", "logger.Middleware", "middleware.Limiter",
+		"requester.TestRequester_MiddlewareNames"}, rq.MiddlewareNames())
+	assert.Equal(t, []string{"middleware.Header", "logger.Middleware", "middleware.Limiter",
+		"requester.TestRequester_MiddlewareNames", "middleware.JSON"}, rq2.MiddlewareNames())
+	assert.Equal(t, []string{}, New(http.Client{}).MiddlewareNames())
+
+	// the last one is the outermost, called first
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	_, err = rq.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"custom", "transport", "logger"}, calls)
+}
+
+func TestRequester_Warmup(t *testing.T) {
+	var conns, heads int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			atomic.AddInt32(&heads, 1)
+		}
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	var calls int32
+	mw := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return next.RoundTrip(r)
+		}
+		return middleware.RoundTripperFunc(fn)
+	}
+	// own transport, not shared with other tests
+	rq := New(http.Client{Timeout: time.Second}, mw).WithTransportOptions(func(tr *http.Transport) {})
+
+	err := rq.Warmup(context.Background(), ts.URL+"/a", ts.URL+"/b")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&heads))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "made through middlewares")
+	established := atomic.LoadInt32(&conns)
+	assert.True(t, established > 0)
+
+	req, err := http.NewRequest("GET", ts.URL+"/a", http.NoBody)
+	require.NoError(t, err)
+	resp, err := rq.Do(req)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, established, atomic.LoadInt32(&conns), "pooled connection reused")
+
+	err = rq.Warmup(context.Background(), ts.URL+"/a", "http://127.0.0.1:1/blah", "bad\x7furl")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "warmup failed for 2 of 3 urls")
+	assert.Contains(t, err.Error(), "http://127.0.0.1:1/blah")
+	assert.Contains(t, err.Error(), "invalid control character in URL")
+}
+
+func TestRequester_WithClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "blah", r.Header.Get("test"))
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, err := w.Write([]byte("something"))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	rq := New(http.Client{Timeout: time.Second}, middleware.Header("test", "blah"))
+	rqShort := rq.WithClient(http.Client{Timeout: 50 * time.Millisecond})
+	assert.Equal(t, time.Second, rq.client.Timeout, "original requester not modified")
+	assert.Equal(t, 50*time.Millisecond, rqShort.Client().Timeout)
+	assert.Equal(t, []string{"middleware.Header"}, rqShort.MiddlewareNames())
+
+	resp, err := rqShort.Client().Get(ts.URL + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "middleware inherited, header set")
+
+	_, err = rqShort.Client().Get(ts.URL + "/slow")
+	require.Error(t, err, "shorter timeout applied")
+
+	resp, err = rq.Client().Get(ts.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// middlewares not shared between derived requesters
+	rqShort.Use(middleware.JSON)
+	assert.Equal(t, []string{"middleware.Header"}, rq.MiddlewareNames())
+}
+
+func TestRequester_WithNotAliased(t *testing.T) {
+	rq := New(http.Client{}, middleware.Header("k", "v"), middleware.JSON)
+	rq.middlewares = rq.middlewares[:1:2] // spare capacity, append in place would overwrite the shared array
+	rq1 := rq.With(middleware.StripHopByHop)
+	rq2 := rq.With(middleware.HeadersFromContext)
+	assert.Equal(t, []string{"middleware.Header", "middleware.StripHopByHop"}, rq1.MiddlewareNames())
+	assert.Equal(t, []string{"middleware.Header", "middleware.HeadersFromContext"}, rq2.MiddlewareNames())
+	assert.Equal(t, []string{"middleware.Header"}, rq.MiddlewareNames())
+}
+
+func TestRequester_DoBatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, err := w.Write([]byte(r.URL.Path))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	var inFlight, maxInFlight int32
+	mw := func(next http.RoundTripper) http.RoundTripper {
+		fn := func(r *http.Request) (*http.Response, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			return next.RoundTrip(r)
+		}
+		return middleware.RoundTripperFunc(fn)
+	}
+	rq := New(http.Client{Timeout: time.Second}, mw)
+
+	makeReqs := func(paths ...string) []*http.Request {
+		res := make([]*http.Request, 0, len(paths))
+		for _, p := range paths {
+			req, err := http.NewRequest("GET", ts.URL+p, http.NoBody)
+			require.NoError(t, err)
+			res = append(res, req)
+		}
+		return res
+	}
+
+	t.Run("mixed results", func(t *testing.T) {
+		reqs := makeReqs("/1", "/fail", "/3", "/4", "/5", "/6", "/7")
+		reqs = append(reqs, &http.Request{Method: "GET", URL: &url.URL{Scheme: "bad", Host: "example.com"}, Header: http.Header{}})
+		res := rq.DoBatch(context.Background(), reqs, 2)
+		require.Equal(t, 8, len(res))
+		for i, r := range res {
+			assert.Equal(t, i, r.Index)
+			switch i {
+			case 1:
+				require.NoError(t, r.Err)
+				assert.Equal(t, 500, r.Resp.StatusCode)
+			case 7:
+				require.Error(t, r.Err)
+				assert.Contains(t, r.Err.Error(), "unsupported protocol scheme")
+			default:
+				require.NoError(t, r.Err)
+				body, err := io.ReadAll(r.Resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, reqs[i].URL.Path, string(body), "result matches the request")
+			}
+			if r.Resp != nil {
+				require.NoError(t, r.Resp.Body.Close())
+			}
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight), "parallelism respected")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		res := rq.DoBatch(ctx, makeReqs("/1", "/2", "/3"), 1)
+		require.Equal(t, 3, len(res))
+		for _, r := range res {
+			assert.Equal(t, context.Canceled, r.Err)
+			assert.Nil(t, r.Resp)
+		}
+	})
+
+	t.Run("canceled in flight", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}))
+		defer slow.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		reqs := make([]*http.Request, 3)
+		for i := range reqs {
+			req, err := http.NewRequest("GET", slow.URL, http.NoBody)
+			require.NoError(t, err)
+			reqs[i] = req
+		}
+		st := time.Now()
+		res := rq.DoBatch(ctx, reqs, 0)
+		assert.True(t, time.Since(st) < 500*time.Millisecond, "in-flight requests aborted")
+		for _, r := range res {
+			require.Error(t, r.Err)
+			assert.ErrorIs(t, r.Err, context.Canceled)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		atomic.StoreInt32(&maxInFlight, 0)
+		res := rq.DoBatch(context.Background(), makeReqs("/1", "/2", "/3", "/4"), 0)
+		for _, r := range res {
+			require.NoError(t, r.Err)
+			require.NoError(t, r.Resp.Body.Close())
+		}
+		assert.True(t, atomic.LoadInt32(&maxInFlight) > 1)
+	})
+}
+
+func TestWithRequestContext(t *testing.T) {
+	type ctxKey string
+	parent := context.WithValue(context.Background(), ctxKey("parent"), "pv")
+	req, err := http.NewRequestWithContext(parent, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+
+	r, cancel := WithRequestContext(req, time.Second, map[interface{}]interface{}{ctxKey("k1"): "v1", ctxKey("k2"): 42})
+	defer cancel()
+	deadline, ok := r.Context().Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Second), deadline, 100*time.Millisecond)
+	assert.Equal(t, "v1", r.Context().Value(ctxKey("k1")))
+	assert.Equal(t, 42, r.Context().Value(ctxKey("k2")))
+	assert.Equal(t, "pv", r.Context().Value(ctxKey("parent")))
+	assert.Equal(t, req.URL, r.URL)
+
+	_, ok = req.Context().Deadline()
+	assert.False(t, ok, "original request not changed")
+	assert.Nil(t, req.Context().Value(ctxKey("k1")))
+
+	r, cancel = WithRequestContext(req, 0, nil)
+	_, ok = r.Context().Deadline()
+	assert.False(t, ok, "no deadline for zero timeout")
+	cancel()
+	assert.ErrorIs(t, r.Context().Err(), context.Canceled, "released by cancel")
+
+	r, cancel = WithRequestContext(req, time.Millisecond, nil)
+	defer cancel()
+	select {
+	case <-r.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled by timeout")
+	}
+
+	r, cancel = WithRequestContext(req, time.Hour, nil)
+	cancel()
+	assert.ErrorIs(t, r.Context().Err(), context.Canceled, "released before timeout")
+	assert.NoError(t, req.Context().Err(), "parent context not canceled")
+}
+
+func TestNewWithOptions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(r.URL.Path + " " + r.Header.Get("k1")))
+	}))
+	defer ts.Close()
+
+	base, err := url.Parse(ts.URL + "/v1/")
+	require.NoError(t, err)
+	var trCalls int32
+	tr := middleware.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&trCalls, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	var urls []string
+	mw := func(next http.RoundTripper) http.RoundTripper {
+		return middleware.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			urls = append(urls, r.URL.String())
+			return next.RoundTrip(r)
+		})
+	}
+
+	rq := NewWithOptions(WithTimeout(50*time.Millisecond), WithBaseTransport(tr),
+		WithMiddleware(middleware.Header("k1", "v1")), WithMiddleware(mw), WithBaseURL(base))
+
+	get := func(rq *Requester, u string) (string, error) {
+		req, err := http.NewRequest("GET", u, http.NoBody)
+		require.NoError(t, err)
+		resp, err := rq.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), nil
+	}
+
+	body, err := get(rq, "users")
+	require.NoError(t, err)
+	assert.Equal(t, "/v1/users v1", body, "resolved against base, header middleware applied")
+	body, err = get(rq, ts.URL+"/abs")
+	require.NoError(t, err)
+	assert.Equal(t, "/abs v1", body, "absolute url used as-is")
+	_, err = get(rq, "slow")
+	require.Error(t, err, "timeout applied")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&trCalls), "transport used")
+	assert.Equal(t, []string{ts.URL + "/v1/users", ts.URL + "/abs", ts.URL + "/v1/slow"}, urls, "middlewares see resolved url")
+
+	// same as New with the client
+	rqNew := New(http.Client{Timeout: 50 * time.Millisecond, Transport: tr}, middleware.Header("k1", "v1"), mw)
+	assert.Equal(t, rqNew.Client().Timeout, rq.Client().Timeout)
+	assert.Equal(t, rqNew.MiddlewareNames(), rq.MiddlewareNames())
+	body, err = get(rqNew, ts.URL+"/abs")
+	require.NoError(t, err)
+	assert.Equal(t, "/abs v1", body)
+
+	body, err = get(rq.With(middleware.Header("k2", "v2")), "inherited")
+	require.NoError(t, err)
+	assert.Equal(t, "/v1/inherited v1", body, "base url inherited")
+
+	body, err = get(NewWithOptions(), ts.URL+"/default")
+	require.NoError(t, err)
+	assert.Equal(t, "/default ", body)
+}
+
+func TestRequester_DoCtx(t *testing.T) {
+	type ctxKey string
+	var values []interface{}
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		values = append(values, r.Context().Value(ctxKey("k")))
+		select {
+		case <-time.After(200 * time.Millisecond):
+			return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}}
+	rq := New(http.Client{Transport: rmock})
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ctxKey("k"), "v1"), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	st := time.Now()
+	_, err = rq.DoCtx(ctx, req)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, time.Since(st) < 150*time.Millisecond, "deadline honored")
+
+	// request's own context kept
+	reqCtx := context.WithValue(context.Background(), ctxKey("k"), "own")
+	req, err = http.NewRequestWithContext(reqCtx, "GET", "http://example.com/blah", http.NoBody)
+	require.NoError(t, err)
+	resp, err := rq.DoCtx(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	assert.Equal(t, []interface{}{"v1", "own"}, values)
+}
+
+func TestNewWithOptions_BaseContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	base, cancel := context.WithCancel(context.Background())
+	rq := NewWithOptions(WithBaseContext(base))
+	rqDerived := rq.With(middleware.JSON)
+
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	defer reqCancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	st := time.Now()
+	errs := make(chan error, 2)
+	for _, r := range []*Requester{rq, rqDerived} {
+		r := r
+		go func() {
+			req, err := http.NewRequestWithContext(reqCtx, "GET", ts.URL, http.NoBody)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = r.Do(req)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.True(t, time.Since(st) < 500*time.Millisecond, "aborted by base context")
+	assert.NoError(t, reqCtx.Err(), "request's own context still live")
+}
+
+func TestSetDefault(t *testing.T) {
+	var urls []string
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		urls = append(urls, r.Method+" "+r.URL.String()+" "+r.Header.Get("Content-Type"))
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}}
+	SetDefault(New(http.Client{Transport: rmock}, middleware.JSON))
+	defer SetDefault(nil)
+
+	resp, err := Get("http://example.com/blah")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	req, err := http.NewRequest("POST", "http://example.com/post", http.NoBody)
+	require.NoError(t, err)
+	_, err = Do(req)
+	require.NoError(t, err)
+
+	_, err = Get("://bad")
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"GET http://example.com/blah application/json", "POST http://example.com/post application/json"}, urls)
+	assert.Equal(t, 2, rmock.Calls())
+
+	SetDefault(nil)
+	assert.Empty(t, Default().MiddlewareNames(), "reset to the initial requester")
+}
+
+func TestSetDefault_Concurrent(t *testing.T) {
+	defer SetDefault(nil)
+	rmock := &mocks.RoundTripper{RoundTripFunc: func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetDefault(New(http.Client{Transport: rmock}))
+		}()
+		go func() {
+			defer wg.Done()
+			_ = Default()
+		}()
+	}
+	wg.Wait()
+	resp, err := Get("http://example.com/blah")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
 func ExampleNew() {
 	// make requester, set JSON headers middleware
 	rq := New(http.Client{Timeout: 3 * time.Second}, middleware.JSON)